@@ -13,12 +13,13 @@ package main
 
 import (
 	"atlantis/router/router"
+	"atlantis/router/tracing"
 	"flag"
 	"log"
 	"log/syslog"
 )
 
-var servers string
+var servers, zkAuth, spans string
 
 func main() {
 	// Logging to syslog is more performant, which matters.
@@ -31,5 +32,17 @@ func main() {
 	}
 
 	flag.StringVar(&servers, "zk", "localhost:2181", "zookeeper connection string")
-	router.New(servers, 8080).Run()
+	flag.StringVar(&zkAuth, "zk-auth", "", "zookeeper auth as scheme:credentials, needed to read certificates")
+	flag.StringVar(&spans, "spans", "", "OTLP/HTTP endpoint or file:// URL to export request spans to")
+	flag.Parse()
+
+	r := router.NewAuth(servers, zkAuth, 8080)
+	if spans != "" {
+		exporter, err := tracing.NewExporter(spans)
+		if err != nil {
+			log.Fatalf("[ERROR] cannot export spans: %s", err)
+		}
+		r.Tracer = tracing.NewTracer(exporter)
+	}
+	r.Run()
 }
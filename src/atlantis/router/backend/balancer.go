@@ -0,0 +1,253 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	BalanceLeastConn  = "leastconn"
+	BalanceRoundRobin = "roundrobin"
+	BalanceWeighted   = "weighted"
+	BalanceRandom     = "random"
+	BalancePowerOfTwo = "p2c"
+	BalanceHash       = "hash"
+)
+
+// A Balancer picks the server which should receive the request. Servers is the
+// pool's server list in stable order, and accept is the pool's accepting
+// status, to be passed on to Server.Cost() and Server.Weight(). The request
+// may be nil when there is none to go by. Servers at their maxconn are passed
+// over like unavailable ones. Balancers are shared by all requests to a pool
+// and must be safe for concurrent use.
+type Balancer interface {
+	Next(servers []*Server, accept string, req *http.Request) *Server
+}
+
+func IsValidBalancer(name string) bool {
+	switch strings.ToLower(name) {
+	case BalanceLeastConn, BalanceRoundRobin, BalanceWeighted, BalanceRandom, BalancePowerOfTwo, BalanceHash:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewBalancer returns the strategy named in config, defaulting to least cost.
+func NewBalancer(config PoolConfig) Balancer {
+	switch strings.ToLower(config.Balancer) {
+	case BalanceRoundRobin:
+		return &RoundRobinBalancer{}
+	case BalanceWeighted:
+		return &WeightedBalancer{}
+	case BalanceRandom:
+		return &RandomBalancer{}
+	case BalancePowerOfTwo:
+		return &PowerOfTwoBalancer{}
+	case BalanceHash:
+		return NewHashBalancer(config.HashKey)
+	default:
+		return &LeastConnBalancer{}
+	}
+}
+
+// Never send traffic to servers under maintenance, unknown, ejected as
+// outliers or with their circuit breaker open.
+func IsAvailable(server *Server) bool {
+	return !strings.EqualFold(server.Status.Current, StatusMaintenance) &&
+		!strings.EqualFold(server.Status.Current, StatusUnknown) &&
+		!server.Outlier.Ejected() && !server.Breaker.Open()
+}
+
+// Balancers pick among available servers with a free slot under their
+// maxconn, so that requests don't wait behind a saturated server while others
+// are idle. See Pool.Next() for when all are saturated.
+func hasCapacity(server *Server) bool {
+	return IsAvailable(server) && !server.Queue.Busy()
+}
+
+// The available server with the fewest requests waiting, for when none has
+// capacity.
+func shortestQueue(servers []*Server) *Server {
+	var next *Server
+	waiting := 0
+	for _, server := range servers {
+		if !IsAvailable(server) {
+			continue
+		}
+		if n := server.Queue.Len(); next == nil || n < waiting {
+			next, waiting = server, n
+		}
+	}
+	return next
+}
+
+func availableServers(servers []*Server) []*Server {
+	list := make([]*Server, 0, len(servers))
+	for _, server := range servers {
+		if hasCapacity(server) {
+			list = append(list, server)
+		}
+	}
+	return list
+}
+
+// Picks the server with the lowest Cost(), i.e. status, slow start and
+// requests in flight. This is the original router behaviour.
+type LeastConnBalancer struct{}
+
+func (b *LeastConnBalancer) Next(servers []*Server, accept string, req *http.Request) *Server {
+	var next *Server
+	var cost uint32 = 0xffffffff
+
+	for _, server := range servers {
+		if !hasCapacity(server) {
+			continue
+		}
+
+		newCost := server.Cost(accept)
+		if newCost < cost {
+			next, cost = server, newCost
+		}
+	}
+
+	return next
+}
+
+// Cycles through available servers, ignoring their cost.
+type RoundRobinBalancer struct {
+	sync.Mutex
+	next int
+}
+
+func (b *RoundRobinBalancer) Next(servers []*Server, accept string, req *http.Request) *Server {
+	b.Lock()
+	defer b.Unlock()
+
+	for i := 0; i < len(servers); i++ {
+		server := servers[(b.next+i)%len(servers)]
+		if hasCapacity(server) {
+			b.next = (b.next + i + 1) % len(servers)
+			return server
+		}
+	}
+
+	return nil
+}
+
+// Smooth weighted round robin (as in nginx) over Server.Weight(); servers
+// spread evenly in proportion to their weights rather than in bursts.
+type WeightedBalancer struct {
+	sync.Mutex
+	current map[*Server]int
+}
+
+func (b *WeightedBalancer) Next(servers []*Server, accept string, req *http.Request) *Server {
+	b.Lock()
+	defer b.Unlock()
+
+	current := make(map[*Server]int, len(servers))
+	var next *Server
+	total := 0
+
+	for _, server := range servers {
+		if !hasCapacity(server) {
+			continue
+		}
+
+		weight := server.Weight(accept)
+		total += weight
+		current[server] = b.current[server] + weight
+		if next == nil || current[server] > current[next] {
+			next = server
+		}
+	}
+
+	if next != nil {
+		current[next] -= total
+	}
+	// servers removed from the pool are dropped along the way
+	b.current = current
+
+	return next
+}
+
+// Picks a random server with probability proportional to Server.Weight().
+type RandomBalancer struct{}
+
+func (b *RandomBalancer) Next(servers []*Server, accept string, req *http.Request) *Server {
+	list := availableServers(servers)
+	if len(list) == 0 {
+		return nil
+	}
+
+	weights := make([]int, len(list))
+	total := 0
+	for i, server := range list {
+		weights[i] = server.Weight(accept)
+		total += weights[i]
+	}
+
+	n := rand.Intn(total)
+	for i, weight := range weights {
+		if n < weight {
+			return list[i]
+		}
+		n -= weight
+	}
+
+	return list[len(list)-1]
+}
+
+// Picks two random servers and sends the request to the one with lower
+// Cost(). Nearly as good as least cost, but constant time in pool size unless
+// most of the pool is unavailable.
+type PowerOfTwoBalancer struct{}
+
+func (b *PowerOfTwoBalancer) Next(servers []*Server, accept string, req *http.Request) *Server {
+	if len(servers) > 1 {
+		i := rand.Intn(len(servers))
+		j := rand.Intn(len(servers) - 1)
+		if j >= i {
+			j++
+		}
+		if hasCapacity(servers[i]) && hasCapacity(servers[j]) {
+			return cheaper(servers[i], servers[j], accept)
+		}
+	}
+
+	list := availableServers(servers)
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+
+	i := rand.Intn(len(list))
+	j := rand.Intn(len(list) - 1)
+	if j >= i {
+		j++
+	}
+	return cheaper(list[i], list[j], accept)
+}
+
+func cheaper(a, b *Server, accept string) *Server {
+	if b.Cost(accept) < a.Cost(accept) {
+		return b
+	}
+	return a
+}
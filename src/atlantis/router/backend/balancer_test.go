@@ -0,0 +1,136 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Servers which have been OK for long enough to be out of slow start.
+func newTestServers(statuses ...string) []*Server {
+	servers := make([]*Server, len(statuses))
+	for i, status := range statuses {
+		servers[i] = NewServer(fmt.Sprintf("127.0.0.1:%d", 8080+i))
+		servers[i].Status.Set(status)
+		servers[i].Status.Changed = time.Unix(0, 0)
+	}
+	return servers
+}
+
+func TestIsValidBalancer(t *testing.T) {
+	valids := []string{BalanceLeastConn, BalanceRoundRobin, BalanceWeighted, BalanceRandom, BalancePowerOfTwo, BalanceHash, "RoundRobin"}
+	for _, name := range valids {
+		if !IsValidBalancer(name) {
+			t.Errorf("%s is valid balancer", name)
+		}
+	}
+
+	if IsValidBalancer("Po-taa-tooo") {
+		t.Errorf("Po-taa-tooo is not a valid balancer")
+	}
+}
+
+func TestNewBalancer(t *testing.T) {
+	if _, ok := NewBalancer(PoolConfig{}).(*LeastConnBalancer); !ok {
+		t.Errorf("should default to least cost")
+	}
+	if _, ok := NewBalancer(PoolConfig{Balancer: "ROUNDROBIN"}).(*RoundRobinBalancer); !ok {
+		t.Errorf("should ignore case of name")
+	}
+	if b, ok := NewBalancer(PoolConfig{Balancer: BalanceHash, HashKey: "cookie:user"}).(*HashBalancer); !ok ||
+		b.kind != HashKeyCookie || b.name != "user" {
+		t.Errorf("should pass hash key to hash balancer")
+	}
+}
+
+func TestBalancersSkipUnavailable(t *testing.T) {
+	servers := newTestServers(StatusMaintenance, StatusUnknown, StatusOk, StatusMaintenance)
+	for _, name := range []string{BalanceLeastConn, BalanceRoundRobin, BalanceWeighted, BalanceRandom, BalancePowerOfTwo, BalanceHash} {
+		balancer := NewBalancer(PoolConfig{Balancer: name})
+		for i := 0; i < 16; i++ {
+			if balancer.Next(servers, StatusOk, nil) != servers[2] {
+				t.Errorf("%s should only return available servers", name)
+				break
+			}
+		}
+		if balancer.Next(servers[:2], StatusOk, nil) != nil {
+			t.Errorf("%s should return nil with no available servers", name)
+		}
+		if balancer.Next([]*Server{}, StatusOk, nil) != nil {
+			t.Errorf("%s should return nil with no servers", name)
+		}
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusMaintenance, StatusOk, StatusCritical)
+	balancer := NewBalancer(PoolConfig{Balancer: BalanceRoundRobin})
+
+	expected := []*Server{servers[0], servers[2], servers[3], servers[0], servers[2]}
+	for i, server := range expected {
+		if balancer.Next(servers, StatusOk, nil) != server {
+			t.Errorf("should cycle through available servers (request %d)", i)
+		}
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusDegraded)
+	balancer := NewBalancer(PoolConfig{Balancer: BalanceWeighted})
+
+	counts := map[*Server]int{}
+	total := servers[0].Weight(StatusOk) + servers[1].Weight(StatusOk)
+	for i := 0; i < total; i++ {
+		counts[balancer.Next(servers, StatusOk, nil)]++
+	}
+
+	if counts[servers[0]] != servers[0].Weight(StatusOk) || counts[servers[1]] != servers[1].Weight(StatusOk) {
+		t.Errorf("should distribute requests in proportion to weight")
+		t.Errorf("%d | %d", counts[servers[0]], counts[servers[1]])
+	}
+}
+
+func TestPowerOfTwoBalancer(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk)
+	balancer := NewBalancer(PoolConfig{Balancer: BalancePowerOfTwo})
+
+	// leaving a request open to raise the cost
+	servers[0].Metrics.RequestStart()
+	for i := 0; i < 16; i++ {
+		if balancer.Next(servers, StatusOk, nil) != servers[1] {
+			t.Errorf("should pick cheaper of two servers")
+			break
+		}
+	}
+}
+
+func TestWeight(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusDegraded, StatusCritical)
+
+	if servers[0].Weight(StatusOk) != MaxWeight {
+		t.Errorf("should give full weight to warm accepted server")
+	}
+	if servers[1].Weight(StatusOk) >= servers[0].Weight(StatusOk) ||
+		servers[2].Weight(StatusOk) >= servers[1].Weight(StatusOk) {
+		t.Errorf("should weigh by status")
+	}
+	if servers[2].Weight(StatusCritical) != MaxWeight {
+		t.Errorf("should mask accepting status")
+	}
+
+	servers[0].Status.Changed = time.Now()
+	if servers[0].Weight(StatusOk) != 1 {
+		t.Errorf("should weigh by slow start")
+	}
+}
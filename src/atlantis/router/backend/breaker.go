@@ -0,0 +1,214 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/logger"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "CLOSED"
+	BreakerOpen     = "OPEN"
+	BreakerHalfOpen = "HALF-OPEN"
+)
+
+const (
+	DefaultBreakerMinRequests = 20
+	DefaultBreakerWindow      = 10 * time.Second
+	DefaultBreakerOpenTime    = 30 * time.Second
+	// Requests let through to test the waters when half open; all must
+	// succeed to close the breaker again.
+	BreakerProbes = 5
+	// Granularity of the sliding window.
+	breakerBuckets = 10
+)
+
+type breakerBucket struct {
+	start            time.Time
+	requests, errors int
+}
+
+// A CircuitBreaker fails requests fast while the error rate over the sliding
+// window is above the threshold, rather than letting them queue up on an
+// overloaded backend. It opens when the rate crosses the threshold with at
+// least the minimum number of requests in the window, turns half open after
+// the open time to let a few probes through, and closes once those succeed.
+type CircuitBreaker struct {
+	sync.Mutex
+	name        string
+	errorRate   int
+	minRequests int
+	window      time.Duration
+	openTime    time.Duration
+	state       string
+	changed     time.Time
+	buckets     [breakerBuckets]breakerBucket
+	probes      int
+	successes   int
+}
+
+// Returns nil when the breaker is disabled in config, which is safe to use.
+func NewCircuitBreaker(name string, config PoolConfig) *CircuitBreaker {
+	if config.BreakerErrorRate <= 0 {
+		return nil
+	}
+
+	breaker := &CircuitBreaker{
+		name:        name,
+		errorRate:   config.BreakerErrorRate,
+		minRequests: config.BreakerMinRequests,
+		window:      config.BreakerWindow,
+		openTime:    config.BreakerOpenTime,
+		state:       BreakerClosed,
+		changed:     time.Now(),
+	}
+	if breaker.minRequests == 0 {
+		breaker.minRequests = DefaultBreakerMinRequests
+	}
+	if breaker.window == 0 {
+		breaker.window = DefaultBreakerWindow
+	}
+	if breaker.openTime == 0 {
+		breaker.openTime = DefaultBreakerOpenTime
+	}
+
+	return breaker
+}
+
+// Must be called holding lock on breaker.
+func (b *CircuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	logger.Printf("[breaker %s] %s -> %s", b.name, b.state, state)
+
+	b.state, b.changed = state, time.Now()
+	b.probes, b.successes = 0, 0
+	if state == BreakerClosed {
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+}
+
+// Open breakers turn half open once the open time has passed. Must be called
+// holding lock on breaker.
+func (b *CircuitBreaker) current() string {
+	if b.state == BreakerOpen && time.Since(b.changed) >= b.openTime {
+		b.setState(BreakerHalfOpen)
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.current()
+}
+
+func (b *CircuitBreaker) Changed() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.changed
+}
+
+// Whether a request may go ahead. Every allowed request must be followed by a
+// call to Record with its outcome.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.current() {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probes >= BreakerProbes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// Whether the breaker lets no traffic through, without taking a probe.
+func (b *CircuitBreaker) Open() bool {
+	return b.State() == BreakerOpen
+}
+
+func (b *CircuitBreaker) Record(success bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.current() {
+	case BreakerHalfOpen:
+		if !success {
+			b.setState(BreakerOpen)
+		} else if b.successes++; b.successes >= BreakerProbes {
+			b.setState(BreakerClosed)
+		}
+		return
+	case BreakerOpen:
+		// stragglers from before opening
+		return
+	}
+
+	bucket := b.bucket(time.Now())
+	bucket.requests++
+	if !success {
+		bucket.errors++
+	}
+
+	requests, errors := b.totals(time.Now())
+	if requests >= b.minRequests && errors*100 >= requests*b.errorRate {
+		b.setState(BreakerOpen)
+	}
+}
+
+// Must be called holding lock on breaker.
+func (b *CircuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := b.window / breakerBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// Must be called holding lock on breaker.
+func (b *CircuitBreaker) totals(now time.Time) (requests, errors int) {
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.window {
+			requests += bucket.requests
+			errors += bucket.errors
+		}
+	}
+	return
+}
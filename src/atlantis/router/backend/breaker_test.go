@@ -0,0 +1,128 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker() *CircuitBreaker {
+	return NewCircuitBreaker("test", PoolConfig{
+		BreakerErrorRate:   50,
+		BreakerMinRequests: 4,
+		BreakerWindow:      time.Second,
+		BreakerOpenTime:    50 * time.Millisecond,
+	})
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	var breaker *CircuitBreaker = NewCircuitBreaker("test", PoolConfig{})
+	if breaker != nil {
+		t.Errorf("should be disabled without error rate")
+	}
+	breaker.Record(false)
+	if !breaker.Allow() || breaker.Open() || breaker.State() != BreakerClosed {
+		t.Errorf("nil breaker should let everything through")
+	}
+}
+
+func TestBreakerOpen(t *testing.T) {
+	breaker := newTestBreaker()
+
+	breaker.Record(false)
+	breaker.Record(false)
+	breaker.Record(false)
+	if breaker.State() != BreakerClosed {
+		t.Errorf("should not open below min requests")
+	}
+
+	breaker.Record(true)
+	if breaker.State() != BreakerOpen || breaker.Allow() {
+		t.Errorf("should open above error rate")
+	}
+}
+
+func TestBreakerBelowRate(t *testing.T) {
+	breaker := newTestBreaker()
+
+	for i := 0; i < 10; i++ {
+		breaker.Record(true)
+	}
+	breaker.Record(false)
+	breaker.Record(false)
+	if breaker.State() != BreakerClosed || !breaker.Allow() {
+		t.Errorf("should stay closed below error rate")
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	breaker := newTestBreaker()
+	breaker.window = 100 * time.Millisecond
+
+	breaker.Record(false)
+	breaker.Record(false)
+	breaker.Record(false)
+	time.Sleep(150 * time.Millisecond)
+	breaker.Record(false)
+	if breaker.State() != BreakerClosed {
+		t.Errorf("should forget requests outside the window")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	breaker := newTestBreaker()
+	for i := 0; i < 4; i++ {
+		breaker.Record(false)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if breaker.State() != BreakerHalfOpen {
+		t.Errorf("should half open after open time")
+	}
+	for i := 0; i < BreakerProbes; i++ {
+		if !breaker.Allow() {
+			t.Errorf("should allow probes when half open")
+		}
+	}
+	if breaker.Allow() {
+		t.Errorf("should limit probes when half open")
+	}
+	for i := 0; i < BreakerProbes; i++ {
+		breaker.Record(true)
+	}
+	if breaker.State() != BreakerClosed || !breaker.Allow() {
+		t.Errorf("should close after successful probes")
+	}
+
+	for i := 0; i < 4; i++ {
+		breaker.Record(false)
+	}
+	time.Sleep(60 * time.Millisecond)
+	breaker.Allow()
+	breaker.Record(false)
+	if breaker.State() != BreakerOpen {
+		t.Errorf("should reopen on failed probe")
+	}
+}
+
+func TestServerBreaker(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk)
+	servers[0].Breaker = newTestBreaker()
+	for i := 0; i < 4; i++ {
+		servers[0].Breaker.Record(false)
+	}
+
+	if IsAvailable(servers[0]) || !IsAvailable(servers[1]) {
+		t.Errorf("servers with open breaker should be unavailable")
+	}
+}
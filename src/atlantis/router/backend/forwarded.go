@@ -0,0 +1,128 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Name the router goes by in Via headers.
+const ViaPseudonym = "atlantis-router"
+
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host",
+	"X-Forwarded-Port"}
+
+// Whether the client of a request is in one of the networks, as in
+// IsTrusted().
+func IsTrustedClient(nets []*net.IPNet, req *http.Request) bool {
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return IsTrusted(nets, addr)
+}
+
+// StripForwarded drops the forwarding headers of untrusted clients, which
+// could otherwise pass for someone else.
+func StripForwarded(header http.Header) {
+	for _, name := range forwardingHeaders {
+		header.Del(name)
+	}
+}
+
+// Adds the client to X-Forwarded-For, Forwarded and Via, and sets
+// X-Forwarded-Proto, -Host and -Port unless a trusted proxy before us did.
+func forwarded(req *http.Request) {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if client == "" {
+		client = "unknown"
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	appendHeader(req.Header, "X-Forwarded-For", client)
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" && req.Host != "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	if req.Header.Get("X-Forwarded-Port") == "" {
+		if port := localPort(req.Context()); port != "" {
+			req.Header.Set("X-Forwarded-Port", port)
+		}
+	}
+
+	element := "for=" + forwardedNode(client)
+	if req.Host != "" {
+		element += ";host=" + forwardedValue(req.Host)
+	}
+	element += ";proto=" + proto
+	appendHeader(req.Header, "Forwarded", element)
+
+	version := fmt.Sprintf("%d.%d", req.ProtoMajor, req.ProtoMinor)
+	if req.ProtoMajor > 1 {
+		version = fmt.Sprintf("%d", req.ProtoMajor)
+	}
+	appendHeader(req.Header, "Via", version+" "+ViaPseudonym)
+}
+
+// Lists are joined into one header, as some servers only read the first.
+func appendHeader(header http.Header, name, value string) {
+	if prior := header.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	header.Set(name, value)
+}
+
+// RFC 7239 nodes, where IPv6 addresses are bracketed and quoted.
+func forwardedNode(client string) string {
+	if strings.Contains(client, ":") {
+		return `"[` + client + `]"`
+	}
+	return client
+}
+
+// RFC 7239 values are quoted unless they are tokens.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return fmt.Sprintf("%q", value)
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x7f && c > 0x20 && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c)
+}
+
+func localPort(ctx context.Context) string {
+	addr := localAddr(ctx)
+	if addr == nil {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
@@ -0,0 +1,88 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestForwarded(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req.RemoteAddr = "[2001:db8::1]:56324"
+	local, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:8080")
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+	forwarded(req)
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "2001:db8::1",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "www.example.com",
+		"X-Forwarded-Port":  "8080",
+		"Forwarded":         `for="[2001:db8::1]";host=www.example.com;proto=http`,
+		"Via":               "1.1 " + ViaPseudonym,
+	}
+	for name, value := range expected {
+		if req.Header.Get(name) != value {
+			t.Errorf("should set %s to %s, got %s", name, value, req.Header.Get(name))
+		}
+	}
+}
+
+func TestForwardedProxied(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://www.example.com:8443/", nil)
+	req.RemoteAddr = "10.1.2.3:56324"
+	req.TLS = &tls.ConnectionState{}
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	req.Header.Add("X-Forwarded-For", "192.0.2.1")
+	req.Header.Add("X-Forwarded-For", "192.0.2.2")
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("Forwarded", "for=192.0.2.1")
+	req.Header.Set("Via", "1.0 fred")
+	forwarded(req)
+
+	expected := map[string]string{
+		"X-Forwarded-For":   "192.0.2.1, 192.0.2.2, 10.1.2.3",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-Host":  "www.example.com:8443",
+		"X-Forwarded-Port":  "",
+		"Forwarded":         `for=192.0.2.1, for=10.1.2.3;host="www.example.com:8443";proto=https`,
+		"Via":               "1.0 fred, 2 " + ViaPseudonym,
+	}
+	for name, value := range expected {
+		if req.Header.Get(name) != value {
+			t.Errorf("should set %s to %s, got %s", name, value, req.Header.Get(name))
+		}
+	}
+}
+
+func TestStripForwarded(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:56324"
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Forwarded", "for=10.0.0.1")
+	req.Header.Set("Via", "1.1 fred")
+
+	nets, _ := ParseCIDRs("10.0.0.0/8")
+	client, _ := ParseCIDRs("192.0.2.1")
+	if IsTrustedClient(nets, req) || IsTrustedClient(nil, req) || !IsTrustedClient(client, req) {
+		t.Errorf("should trust clients in the networks only")
+	}
+	StripForwarded(req.Header)
+	if req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("Forwarded") != "" ||
+		req.Header.Get("Via") == "" {
+		t.Errorf("should strip forwarding headers")
+	}
+}
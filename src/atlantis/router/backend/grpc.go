@@ -0,0 +1,132 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const GRPCStatusHeader = "Grpc-Status"
+
+// gRPC status codes which tell of trouble with the server rather than the
+// request, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html.
+const (
+	GRPCOK               = 0
+	GRPCUnknown          = 2
+	GRPCDeadlineExceeded = 4
+	GRPCInternal         = 13
+	GRPCUnavailable      = 14
+	GRPCDataLoss         = 15
+)
+
+func IsGRPC(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatus of a response is in its trailers, or in its headers when it has
+// no body.
+func GRPCStatus(header, trailer http.Header) (int, bool) {
+	value := trailer.Get(GRPCStatusHeader)
+	if value == "" {
+		value = header.Get(GRPCStatusHeader)
+	}
+	code, err := strconv.Atoi(value)
+	return code, err == nil
+}
+
+// ResponseStatus is the status code of a response as far as outlier detection,
+// circuit breakers and metrics are concerned: gRPC responses are always 200,
+// so server side gRPC errors count as the 5xx they would have been.
+func ResponseStatus(status int, header, trailer http.Header) int {
+	if status != http.StatusOK || !IsGRPC(header) {
+		return status
+	}
+	code, _ := GRPCStatus(header, trailer)
+	switch code {
+	case GRPCUnknown, GRPCInternal, GRPCDataLoss:
+		return http.StatusInternalServerError
+	case GRPCUnavailable:
+		return http.StatusServiceUnavailable
+	case GRPCDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return status
+}
+
+// Messages of the standard gRPC health protocol, grpc.health.v1.Health/Check.
+const (
+	GRPCHealthPath = "/grpc.health.v1.Health/Check"
+	grpcServing    = 1
+)
+
+// Length prefixed HealthCheckRequest{service}.
+func grpcHealthRequest(service string) []byte {
+	msg := []byte{}
+	if service != "" {
+		msg = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(service)))...)
+		msg = append(msg, service...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// Whether the length prefixed HealthCheckResponse says SERVING.
+func grpcHealthServing(body io.Reader) (bool, error) {
+	frame := make([]byte, 5)
+	if _, err := io.ReadFull(body, frame); err != nil {
+		return false, err
+	}
+	size := binary.BigEndian.Uint32(frame[1:])
+	if frame[0] != 0 || size > MaxHealthzBody {
+		return false, errors.New("unexpected health check response")
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return false, err
+	}
+
+	// the status is field 1, a varint; skip any other
+	r := bytes.NewReader(msg)
+	for r.Len() > 0 {
+		key, err := binary.ReadUvarint(r)
+		if err != nil {
+			return false, err
+		}
+		switch key & 7 {
+		case 0:
+			value, err := binary.ReadUvarint(r)
+			if err != nil {
+				return false, err
+			}
+			if key>>3 == 1 {
+				return value == grpcServing, nil
+			}
+		case 2:
+			size, err := binary.ReadUvarint(r)
+			if err != nil || size > uint64(r.Len()) {
+				return false, errors.New("unexpected health check response")
+			}
+			r.Seek(int64(size), io.SeekCurrent)
+		default:
+			return false, errors.New("unexpected health check response")
+		}
+	}
+	// UNKNOWN is the zero value, left out on the wire
+	return false, nil
+}
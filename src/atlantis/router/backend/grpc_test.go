@@ -0,0 +1,147 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/logger"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseStatus(t *testing.T) {
+	grpc := http.Header{"Content-Type": {"application/grpc+proto"}}
+	tests := []struct {
+		status          int
+		header, trailer http.Header
+		expected        int
+	}{
+		{http.StatusOK, http.Header{}, http.Header{GRPCStatusHeader: {"14"}}, http.StatusOK},
+		{http.StatusBadGateway, grpc, nil, http.StatusBadGateway},
+		{http.StatusOK, grpc, http.Header{GRPCStatusHeader: {"0"}}, http.StatusOK},
+		{http.StatusOK, grpc, http.Header{GRPCStatusHeader: {"5"}}, http.StatusOK},
+		{http.StatusOK, grpc, http.Header{GRPCStatusHeader: {"14"}}, http.StatusServiceUnavailable},
+		{http.StatusOK, http.Header{"Content-Type": {"application/grpc"}, GRPCStatusHeader: {"13"}}, nil,
+			http.StatusInternalServerError},
+	}
+	for i, test := range tests {
+		if status := ResponseStatus(test.status, test.header, test.trailer); status != test.expected {
+			t.Errorf("%d: expected %d, got %d", i, test.expected, status)
+		}
+	}
+}
+
+func newH2CServer(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func h2cClient() *http.Client {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+func TestGRPCStreaming(t *testing.T) {
+	grpcStatus := "0"
+	backend := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", GRPCStatusHeader)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		msg := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r.Body, msg); err != nil {
+				break
+			}
+			w.Write(msg)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(GRPCStatusHeader, grpcStatus)
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.Listener.Addr().String())
+	server.Transport = NewTransport(PoolConfig{HTTP2: true})
+	frontend := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRecord := logger.NewHAProxyLogRecord(w, r, "test", 0, time.Now())
+		server.Handle(&logRecord, time.Second)
+	}))
+	defer frontend.Close()
+
+	call := func() (*http.Response, error) {
+		body, send := io.Pipe()
+		req, _ := http.NewRequest("POST", frontend.URL+"/echo.Echo/Stream", body)
+		req.Header.Set("Content-Type", "application/grpc")
+		res, err := h2cClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// each message must make it through before the next is sent
+		msg := make([]byte, 4)
+		for _, sent := range []string{"ping", "pong"} {
+			send.Write([]byte(sent))
+			if _, err := io.ReadFull(res.Body, msg); err != nil || string(msg) != sent {
+				t.Errorf("should stream %s both ways, got %q: %v", sent, msg, err)
+			}
+		}
+		send.Close()
+		ioutil.ReadAll(res.Body)
+		return res, nil
+	}
+
+	res, err := call()
+	if err != nil {
+		t.Fatalf("should proxy grpc call: %s", err)
+	}
+	if res.Trailer.Get(GRPCStatusHeader) != "0" || server.Metrics.GRPCErrors != 0 {
+		t.Errorf("should forward grpc status in trailers")
+	}
+
+	grpcStatus = "14"
+	if res, err = call(); err != nil {
+		t.Fatalf("should proxy grpc call: %s", err)
+	}
+	if res.Trailer.Get(GRPCStatusHeader) != "14" || server.Metrics.GRPCErrors != 1 {
+		t.Errorf("should count grpc errors")
+	}
+	if server.Outlier.Consecutive5xx != 1 {
+		t.Errorf("should take unavailable for a server error")
+	}
+}
+
+func TestGRPCHealthMessages(t *testing.T) {
+	req := grpcHealthRequest("echo.Echo")
+	if !bytes.Equal(req, append([]byte{0, 0, 0, 0, 11, 0x0a, 9}, "echo.Echo"...)) {
+		t.Errorf("should encode health check request, got %v", req)
+	}
+
+	serving, err := grpcHealthServing(bytes.NewReader([]byte{0, 0, 0, 0, 2, 0x08, 1}))
+	if err != nil || !serving {
+		t.Errorf("should decode serving response")
+	}
+	serving, err = grpcHealthServing(bytes.NewReader([]byte{0, 0, 0, 0, 5, 0x12, 1, 'x', 0x08, 2}))
+	if err != nil || serving {
+		t.Errorf("should decode not serving response skipping unknown fields")
+	}
+	if _, err = grpcHealthServing(bytes.NewReader([]byte{0, 0, 0, 0, 2, 0x08})); err == nil {
+		t.Errorf("should fail on truncated response")
+	}
+}
@@ -0,0 +1,198 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"hash/crc32"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Request attribute a HashBalancer is keyed by, written as "ip", "path",
+// "header:<name>", "cookie:<name>" or "query:<name>".
+const (
+	HashKeyIP     = "ip"
+	HashKeyPath   = "path"
+	HashKeyHeader = "header"
+	HashKeyCookie = "cookie"
+	HashKeyQuery  = "query"
+)
+
+const (
+	// Points on the ring per server of DefaultWeight.
+	HashReplicas = 100
+	// A server takes at most HashLoadFactor times the average requests in
+	// flight before its keys spill over to the next server on the ring.
+	HashLoadFactor = 1.25
+)
+
+func IsValidHashKey(key string) bool {
+	kind, name := splitHashKey(key)
+	switch kind {
+	case HashKeyIP, HashKeyPath:
+		return name == ""
+	case HashKeyHeader, HashKeyCookie, HashKeyQuery:
+		return name != ""
+	default:
+		return false
+	}
+}
+
+func splitHashKey(key string) (string, string) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) == 1 {
+		return strings.ToLower(parts[0]), ""
+	}
+	return strings.ToLower(parts[0]), parts[1]
+}
+
+type hashPoint struct {
+	hash   uint32
+	server *Server
+}
+
+type hashRing []hashPoint
+
+func (r hashRing) Len() int           { return len(r) }
+func (r hashRing) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r hashRing) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// Consistent hashing with bounded loads: requests with the same key go to the
+// same server as long as it is available and not loaded beyond HashLoadFactor
+// of the pool average, else to the next server along the ring. Points are
+// derived from server addresses, so adding or removing a server only moves
+// the keys next to its points. Requests without the key fall back to least
+// cost.
+type HashBalancer struct {
+	sync.Mutex
+	kind, name string
+	servers    []*Server
+	ring       hashRing
+	fallback   LeastConnBalancer
+}
+
+func NewHashBalancer(key string) *HashBalancer {
+	kind, name := splitHashKey(key)
+	return &HashBalancer{
+		kind: kind,
+		name: name,
+	}
+}
+
+func (b *HashBalancer) key(req *http.Request) (string, bool) {
+	if req == nil {
+		return "", false
+	}
+
+	switch b.kind {
+	case HashKeyIP:
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr, req.RemoteAddr != ""
+		}
+		return host, true
+	case HashKeyPath:
+		return req.URL.Path, true
+	case HashKeyHeader:
+		val := req.Header.Get(b.name)
+		return val, val != ""
+	case HashKeyCookie:
+		cookie, err := req.Cookie(b.name)
+		if err != nil {
+			return "", false
+		}
+		return cookie.Value, true
+	case HashKeyQuery:
+		val := req.URL.Query().Get(b.name)
+		return val, val != ""
+	default:
+		return "", false
+	}
+}
+
+// Pools replace their server list whenever servers are added or removed, so
+// comparing lists is enough to tell when to rebuild the ring. Must be called
+// holding lock on balancer.
+func (b *HashBalancer) update(servers []*Server) {
+	if len(servers) == len(b.servers) && (len(servers) == 0 || &servers[0] == &b.servers[0]) {
+		return
+	}
+
+	ring := hashRing{}
+	for _, server := range servers {
+		replicas := HashReplicas * int(server.weight()) / DefaultWeight
+		if replicas < 1 {
+			replicas = 1
+		}
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(server.Address + "-" + strconv.Itoa(i)))
+			ring = append(ring, hashPoint{hash, server})
+		}
+	}
+	sort.Sort(ring)
+
+	b.servers, b.ring = servers, ring
+}
+
+func (b *HashBalancer) Next(servers []*Server, accept string, req *http.Request) *Server {
+	key, ok := b.key(req)
+	if !ok {
+		return b.fallback.Next(servers, accept, req)
+	}
+
+	b.Lock()
+	b.update(servers)
+	ring := b.ring
+	b.Unlock()
+
+	if len(ring) == 0 {
+		return nil
+	}
+
+	// bound on requests in flight per DefaultWeight, counting this one
+	var inFlight, weight uint64
+	for _, server := range servers {
+		if IsAvailable(server) {
+			inFlight += uint64(server.Metrics.RequestsInFlight)
+			weight += uint64(server.weight())
+		}
+	}
+	if weight == 0 {
+		return nil
+	}
+	bound := math.Ceil(HashLoadFactor * float64(inFlight+1) * DefaultWeight / float64(weight))
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+
+	var first *Server
+	for i := 0; i < len(ring); i++ {
+		server := ring[(start+i)%len(ring)].server
+		if !hasCapacity(server) {
+			continue
+		}
+		if first == nil {
+			first = server
+		}
+		if float64(server.Metrics.RequestsInFlight)*DefaultWeight/float64(server.weight()) < bound {
+			return server
+		}
+	}
+
+	// only reachable if the servers' loads changed under us
+	return first
+}
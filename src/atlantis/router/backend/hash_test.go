@@ -0,0 +1,127 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func newHashRequest(user string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://www.ooyala.com/?user="+user, nil)
+	req.Header.Set("X-User", user)
+	req.AddCookie(&http.Cookie{Name: "user", Value: user})
+	req.RemoteAddr = user + ":4242"
+	return req
+}
+
+func TestIsValidHashKey(t *testing.T) {
+	valids := []string{"ip", "path", "header:X-User", "cookie:user", "Query:user"}
+	for _, key := range valids {
+		if !IsValidHashKey(key) {
+			t.Errorf("%s is valid hash key", key)
+		}
+	}
+
+	invalids := []string{"", "header", "ip:me", "body:json"}
+	for _, key := range invalids {
+		if IsValidHashKey(key) {
+			t.Errorf("%s is not a valid hash key", key)
+		}
+	}
+}
+
+func TestHashBalancerKeys(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk, StatusOk, StatusOk, StatusOk)
+
+	for _, key := range []string{"ip", "header:X-User", "cookie:user", "query:user"} {
+		balancer := NewHashBalancer(key)
+		for i := 0; i < 16; i++ {
+			req := newHashRequest(fmt.Sprintf("10.0.0.%d", i))
+			if balancer.Next(servers, StatusOk, req) != balancer.Next(servers, StatusOk, req) {
+				t.Errorf("%s should send same key to same server", key)
+			}
+		}
+	}
+}
+
+func TestHashBalancerFallback(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk)
+	servers[0].Metrics.RequestStart()
+
+	balancer := NewHashBalancer("header:X-Missing")
+	if balancer.Next(servers, StatusOk, newHashRequest("mickey")) != servers[1] {
+		t.Errorf("should fall back to least cost without key")
+	}
+	if balancer.Next(servers, StatusOk, nil) != servers[1] {
+		t.Errorf("should fall back to least cost without request")
+	}
+}
+
+func TestHashBalancerRemapping(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk, StatusOk, StatusOk, StatusOk)
+	balancer := NewHashBalancer("header:X-User")
+
+	before := map[string]*Server{}
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user%d", i)
+		before[user] = balancer.Next(servers, StatusOk, newHashRequest(user))
+	}
+
+	// as the pool does, a new list without the last server
+	removed := servers[len(servers)-1]
+	servers = append([]*Server{}, servers[:len(servers)-1]...)
+
+	moved := 0
+	for user, server := range before {
+		next := balancer.Next(servers, StatusOk, newHashRequest(user))
+		if server != removed && next != server {
+			moved++
+		}
+		if next == removed {
+			t.Fatalf("should not send requests to removed server")
+		}
+	}
+
+	if moved != 0 {
+		t.Errorf("should only remap keys of removed server, moved %d", moved)
+	}
+}
+
+func TestHashBalancerUnavailable(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk)
+	balancer := NewHashBalancer("header:X-User")
+
+	req := newHashRequest("mickey")
+	server := balancer.Next(servers, StatusOk, req)
+	server.Status.Set(StatusMaintenance)
+
+	if next := balancer.Next(servers, StatusOk, req); next == server || next == nil {
+		t.Errorf("should skip unavailable servers")
+	}
+}
+
+func TestHashBalancerBoundedLoad(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk, StatusOk, StatusOk)
+	balancer := NewHashBalancer("header:X-User")
+
+	req := newHashRequest("mickey")
+	hot := balancer.Next(servers, StatusOk, req)
+	for i := 0; i < 8; i++ {
+		hot.Metrics.RequestStart()
+	}
+
+	if balancer.Next(servers, StatusOk, req) == hot {
+		t.Errorf("should spill over from overloaded server")
+	}
+}
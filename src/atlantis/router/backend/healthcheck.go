@@ -0,0 +1,190 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	HealthzHTTP = "http"
+	HealthzTCP  = "tcp"
+	HealthzGRPC = "grpc"
+)
+
+const (
+	DefaultHealthzPath   = "/healthz"
+	DefaultHealthzMethod = "GET"
+	DefaultHealthzRise   = 1
+	DefaultHealthzFall   = 1
+	// Only this much of a response is searched for the expected body.
+	MaxHealthzBody = 64 * 1024
+)
+
+func IsValidHealthzMode(mode string) bool {
+	return strings.EqualFold(mode, HealthzHTTP) || strings.EqualFold(mode, HealthzTCP) ||
+		strings.EqualFold(mode, HealthzGRPC)
+}
+
+// Expected status codes are written as a list, e.g. "200,204".
+func IsValidHealthzExpect(expect string) bool {
+	for _, code := range strings.Split(expect, ",") {
+		if c, err := strconv.Atoi(strings.TrimSpace(code)); err != nil || c < 100 || c > 599 {
+			return false
+		}
+	}
+	return true
+}
+
+// A HealthCheck describes how servers of a pool are probed. By default it
+// requests /healthz and takes the status from the Server-Status header. When
+// expected codes or a body are configured the response is judged by those
+// instead: OK if it passes, unless the server also sends a Server-Status, and
+// CRITICAL if it doesn't. TCP checks only connect. gRPC checks ask the standard
+// health service about the configured service, OK if SERVING and CRITICAL
+// otherwise, which needs servers spoken to over HTTP/2. Servers change status
+// after rise or fall consecutive results, see ServerStatus.Update().
+type HealthCheck struct {
+	tcp     bool
+	grpc    bool
+	service string
+	method  string
+	path    string
+	host    string
+	codes   map[int]bool
+	body    string
+	rise    int
+	fall    int
+}
+
+func NewHealthCheck(config PoolConfig) *HealthCheck {
+	check := &HealthCheck{
+		tcp:     strings.EqualFold(config.HealthzMode, HealthzTCP),
+		grpc:    strings.EqualFold(config.HealthzMode, HealthzGRPC),
+		service: config.HealthzService,
+		method:  strings.ToUpper(config.HealthzMethod),
+		path:    config.HealthzPath,
+		host:    config.HealthzHost,
+		codes:   map[int]bool{},
+		body:    config.HealthzBody,
+		rise:    config.HealthzRise,
+		fall:    config.HealthzFall,
+	}
+	if check.method == "" {
+		check.method = DefaultHealthzMethod
+	}
+	if check.rise == 0 {
+		check.rise = DefaultHealthzRise
+	}
+	if check.fall == 0 {
+		check.fall = DefaultHealthzFall
+	}
+	if check.path == "" {
+		check.path = DefaultHealthzPath
+	}
+	if config.HealthzExpect != "" {
+		for _, code := range strings.Split(config.HealthzExpect, ",") {
+			if c, err := strconv.Atoi(strings.TrimSpace(code)); err == nil {
+				check.codes[c] = true
+			}
+		}
+	}
+	return check
+}
+
+func (c *HealthCheck) Request(address string) (*http.Request, error) {
+	if c.grpc {
+		return c.grpcRequest(address)
+	}
+
+	req, err := http.NewRequest(c.method, "http://"+address+c.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.host != "" {
+		req.Host = c.host
+	}
+	return req, nil
+}
+
+func (c *HealthCheck) grpcRequest(address string) (*http.Request, error) {
+	body := grpcHealthRequest(c.service)
+	req, err := http.NewRequest("POST", "http://"+address+GRPCHealthPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	if c.host != "" {
+		req.Host = c.host
+	}
+	return req, nil
+}
+
+// Whether the status comes from the Server-Status header alone.
+func (c *HealthCheck) headerOnly() bool {
+	return len(c.codes) == 0 && c.body == ""
+}
+
+// Status of a server given its response to the check, which may read the body.
+func (c *HealthCheck) Status(res *http.Response) string {
+	if c.grpc {
+		return c.grpcStatus(res)
+	}
+
+	hdr := res.Header.Get("Server-Status")
+	if c.headerOnly() {
+		if IsValidStatus(hdr) {
+			return hdr
+		}
+		return StatusUnknown
+	}
+
+	if len(c.codes) > 0 && !c.codes[res.StatusCode] {
+		return StatusCritical
+	}
+	if len(c.codes) == 0 && (res.StatusCode < 200 || res.StatusCode > 399) {
+		return StatusCritical
+	}
+	if c.body != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, MaxHealthzBody))
+		if err != nil || !strings.Contains(string(body), c.body) {
+			return StatusCritical
+		}
+	}
+
+	if IsValidStatus(hdr) {
+		return hdr
+	}
+	return StatusOk
+}
+
+func (c *HealthCheck) grpcStatus(res *http.Response) string {
+	if res.StatusCode != http.StatusOK || !IsGRPC(res.Header) {
+		return StatusCritical
+	}
+	// trailers-only responses carry an error and no message
+	if code, ok := GRPCStatus(res.Header, nil); ok && code != GRPCOK {
+		return StatusCritical
+	}
+
+	serving, err := grpcHealthServing(res.Body)
+	if err != nil || !serving {
+		return StatusCritical
+	}
+	return StatusOk
+}
@@ -0,0 +1,150 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/testutils"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckHealthDefault(t *testing.T) {
+	backend := testutils.NewBackend(0, false)
+	defer backend.Shutdown()
+
+	server := NewServer(backend.Address())
+	check := NewHealthCheck(PoolConfig{})
+	backend.SetStatus(http.StatusOK, "DEGRADED")
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusDegraded {
+		t.Errorf("should parse server-status header by default")
+	}
+
+	backend.SetStatus(http.StatusOK, "")
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusUnknown {
+		t.Errorf("should set unknown without server-status header")
+	}
+}
+
+func TestCheckHealthExpect(t *testing.T) {
+	backend := testutils.NewBackend(0, false)
+	defer backend.Shutdown()
+
+	server := NewServer(backend.Address())
+	check := NewHealthCheck(PoolConfig{
+		HealthzPath:   "/ping",
+		HealthzMethod: "head",
+		HealthzHost:   "health.example.com",
+		HealthzExpect: "200, 204",
+	})
+
+	backend.SetResponse(http.StatusNoContent, "")
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusOk {
+		t.Errorf("should set ok on expected status")
+	}
+
+	req := backend.Handler.Recorded.Back().Value.(testutils.RequestAndTime).R
+	if req.Method != "HEAD" || req.URL.Path != "/ping" || req.Host != "health.example.com" {
+		t.Errorf("should send configured request")
+	}
+
+	backend.SetResponse(http.StatusServiceUnavailable, "")
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusCritical {
+		t.Errorf("should set critical on unexpected status")
+	}
+}
+
+func TestCheckHealthBody(t *testing.T) {
+	backend := testutils.NewBackend(0, false)
+	defer backend.Shutdown()
+
+	server := NewServer(backend.Address())
+	check := NewHealthCheck(PoolConfig{HealthzPath: "/ping", HealthzBody: "all good"})
+
+	backend.SetResponse(http.StatusOK, "status: all good")
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusOk {
+		t.Errorf("should set ok when body matches")
+	}
+
+	backend.SetResponse(http.StatusOK, "status: on fire")
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusCritical {
+		t.Errorf("should set critical when body does not match")
+	}
+
+	backend.SetResponse(http.StatusInternalServerError, "status: all good")
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusCritical {
+		t.Errorf("should set critical on error status")
+	}
+}
+
+func TestCheckHealthTCP(t *testing.T) {
+	backend := testutils.NewBackend(0, false)
+	check := NewHealthCheck(PoolConfig{HealthzMode: "TCP"})
+
+	server := NewServer(backend.Address())
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusOk {
+		t.Errorf("should set ok when connecting")
+	}
+	if backend.Handler.Recorded.Len() != 0 {
+		t.Errorf("should not send a request")
+	}
+
+	backend.Shutdown()
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusCritical {
+		t.Errorf("should set critical when connection fails")
+	}
+}
+
+func TestCheckHealthGRPC(t *testing.T) {
+	var service []byte
+	serving := byte(1)
+	backend := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != GRPCHealthPath {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set(GRPCStatusHeader, "12")
+			return
+		}
+		service, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", GRPCStatusHeader)
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, serving})
+		w.Header().Set(GRPCStatusHeader, "0")
+	}))
+	defer backend.Close()
+
+	config := PoolConfig{HealthzMode: HealthzGRPC, HealthzService: "echo.Echo", HTTP2: true}
+	server := NewServer(backend.Listener.Addr().String())
+	server.Transport = NewTransport(config)
+	check := NewHealthCheck(config)
+
+	server.CheckHealth(check, time.Second)
+	if server.Status.Current != StatusOk || !bytes.HasSuffix(service, []byte("echo.Echo")) {
+		t.Errorf("should set ok when service is serving")
+	}
+
+	serving = 2
+	server.CheckHealth(check, time.Second)
+	if server.Status.Current != StatusCritical {
+		t.Errorf("should set critical when service is not serving")
+	}
+}
@@ -0,0 +1,101 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Headers for the connection they came on only, which proxies must not
+// forward (RFC 7230 section 6.1), along with any named in Connection.
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// Whether one of the comma separated lists in values has token.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Strips the hop-by-hop headers off a request before it is forwarded, but
+// for "TE: trailers", which gRPC needs, and the upgrade asked for, if any.
+func sanitizeRequest(req *http.Request) {
+	upgrade := ""
+	if IsUpgrade(req) {
+		upgrade = req.Header.Get("Upgrade")
+	}
+	trailers := hasToken(req.Header["Te"], "trailers")
+
+	removeHopHeaders(req.Header)
+	if trailers {
+		req.Header.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+}
+
+// CheckFraming rejects requests whose body length is ambiguous, which a
+// server could read differently than we do, taking the rest for another
+// request. net/http rejects conflicting Content-Lengths and transfer codings
+// other than chunked, and drops the Content-Length of chunked requests as
+// RFC 7230 section 3.3.3 has proxies do; this catches what gets past it.
+// The transport frames the body anew in any case.
+func CheckFraming(req *http.Request) error {
+	if len(req.Header["Transfer-Encoding"]) > 0 {
+		return errors.New("unparsed transfer encoding")
+	}
+
+	lengths := req.Header["Content-Length"]
+	if len(req.TransferEncoding) > 0 {
+		if len(lengths) > 0 {
+			return errors.New("content length with transfer encoding")
+		}
+		if len(req.TransferEncoding) != 1 || !strings.EqualFold(req.TransferEncoding[0], "chunked") {
+			return errors.New("unsupported transfer encoding")
+		}
+	}
+	if len(lengths) > 1 {
+		return errors.New("multiple content lengths")
+	}
+	if len(lengths) == 1 {
+		length, err := strconv.ParseInt(textproto.TrimString(lengths[0]), 10, 64)
+		if err != nil || length < 0 || length != req.ContentLength {
+			return errors.New("invalid content length")
+		}
+	}
+	return nil
+}
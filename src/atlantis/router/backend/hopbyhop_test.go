@@ -0,0 +1,96 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/testutils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSanitizeRequest(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://www.example.com/", nil)
+	req.Header.Set("Connection", "keep-alive, X-Secret")
+	req.Header.Set("X-Secret", "Minnie")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic bWlja2V5Om1vdXNl")
+	req.Header.Set("Te", "deflate, trailers")
+	req.Header.Set("X-Kept", "Goofy")
+	sanitizeRequest(req)
+
+	for _, name := range []string{"Connection", "X-Secret", "Keep-Alive", "Proxy-Authorization"} {
+		if req.Header.Get(name) != "" {
+			t.Errorf("should strip %s", name)
+		}
+	}
+	if req.Header.Get("Te") != "trailers" || req.Header.Get("X-Kept") != "Goofy" {
+		t.Errorf("should keep TE trailers and end-to-end headers")
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	sanitizeRequest(req)
+	if !IsUpgrade(req) || req.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("should keep upgrade")
+	}
+}
+
+func TestCheckFraming(t *testing.T) {
+	tests := []struct {
+		te     []string
+		header http.Header
+		length int64
+		valid  bool
+	}{
+		{nil, http.Header{}, 0, true},
+		{nil, http.Header{"Content-Length": {"5"}}, 5, true},
+		{[]string{"chunked"}, http.Header{}, -1, true},
+		{nil, http.Header{"Content-Length": {"5"}}, 6, false},
+		{nil, http.Header{"Content-Length": {"5", "6"}}, 5, false},
+		{nil, http.Header{"Content-Length": {"-5"}}, -5, false},
+		{[]string{"chunked"}, http.Header{"Content-Length": {"5"}}, -1, false},
+		{[]string{"gzip", "chunked"}, http.Header{}, -1, false},
+		{nil, http.Header{"Transfer-Encoding": {"chunked"}, "Content-Length": {"5"}}, 5, false},
+	}
+	for i, test := range tests {
+		req := &http.Request{TransferEncoding: test.te, Header: test.header, ContentLength: test.length}
+		if err := CheckFraming(req); (err == nil) != test.valid {
+			t.Errorf("%d: expected valid %t, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestHandleHopHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "Daisy")
+		w.Header().Set("Keep-Alive", "timeout=5")
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.Listener.Addr().String())
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL)
+	logRecord.Request.Header.Set("Proxy-Authorization", "Basic bWlja2V5Om1vdXNl")
+	server.Handle(logRecord, 100*time.Millisecond)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("should strip hop-by-hop request headers")
+	}
+	if rr.Header().Get("X-Hop") != "" || rr.Header().Get("Keep-Alive") != "" {
+		t.Errorf("should strip hop-by-hop response headers, got %v", rr.Header())
+	}
+}
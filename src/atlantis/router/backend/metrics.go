@@ -18,6 +18,8 @@ import (
 type ServerMetrics struct {
 	RequestsInFlight uint32
 	RequestsServiced uint64
+	// Responses with a gRPC status other than OK
+	GRPCErrors uint64
 }
 
 func NewServerMetrics() ServerMetrics {
@@ -36,6 +38,10 @@ func (s *ServerMetrics) RequestDone() {
 	atomic.AddUint32(&s.RequestsInFlight, ^uint32(0))
 }
 
+func (s *ServerMetrics) GRPCError() {
+	atomic.AddUint64(&s.GRPCErrors, uint64(1))
+}
+
 func (s *ServerMetrics) Cost() uint32 {
 	return s.RequestsInFlight
 }
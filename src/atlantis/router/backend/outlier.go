@@ -0,0 +1,230 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/logger"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEjectionTime       = 30 * time.Second
+	DefaultMaxEjectionPercent = 50
+	// Ejections back off exponentially up to this multiple of the ejection time.
+	MaxEjectionMultiple = 16
+	// Servers need this many samples before their latency is compared.
+	OutlierLatencySamples = 20
+	// Weight of the latest sample in a server's moving average latency.
+	outlierLatencyAlpha = 0.1
+)
+
+// Passive health of a server, as seen from the requests it serves rather than
+// its /healthz. Ejected servers get no traffic from Pool.Next().
+type ServerOutlier struct {
+	sync.Mutex
+	Consecutive5xx    int
+	ConsecutiveErrors int
+	Latency           time.Duration
+	Samples           int
+	Ejections         int
+	EjectedUntil      time.Time
+}
+
+func (o *ServerOutlier) Observe(resErr ResponseError, latency time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+
+	switch {
+	case resErr.Error != nil:
+		o.ConsecutiveErrors++
+		o.Consecutive5xx = 0
+	case ResponseStatus(resErr.Response.StatusCode, resErr.Response.Header, resErr.Response.Trailer) >= 500:
+		o.Consecutive5xx++
+		o.ConsecutiveErrors = 0
+	default:
+		o.Consecutive5xx, o.ConsecutiveErrors = 0, 0
+	}
+
+	if o.Samples == 0 {
+		o.Latency = latency
+	} else {
+		o.Latency += time.Duration(outlierLatencyAlpha * float64(latency-o.Latency))
+	}
+	o.Samples++
+}
+
+func (o *ServerOutlier) Ejected() bool {
+	o.Lock()
+	defer o.Unlock()
+
+	return time.Now().Before(o.EjectedUntil)
+}
+
+// Ejects for the base time, doubled for every ejection since the server last
+// stayed in for as long as the longest ejection.
+func (o *ServerOutlier) eject(base time.Duration) time.Duration {
+	o.Lock()
+	defer o.Unlock()
+
+	now := time.Now()
+	if now.Sub(o.EjectedUntil) > base*MaxEjectionMultiple {
+		o.Ejections = 0
+	}
+
+	multiple := 1 << uint(o.Ejections)
+	if multiple > MaxEjectionMultiple {
+		multiple = MaxEjectionMultiple
+	}
+	duration := base * time.Duration(multiple)
+
+	o.Ejections++
+	o.EjectedUntil = now.Add(duration)
+	o.restart()
+
+	return duration
+}
+
+// Servers which weren't ejected, for the maximum percentage, must cross the
+// thresholds afresh rather than be reconsidered on every request.
+func (o *ServerOutlier) spare() {
+	o.Lock()
+	defer o.Unlock()
+
+	o.restart()
+}
+
+// Must be called holding lock on outlier.
+func (o *ServerOutlier) restart() {
+	o.Consecutive5xx, o.ConsecutiveErrors = 0, 0
+	o.Samples = 0
+}
+
+func (o *ServerOutlier) latency() (time.Duration, bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.Latency, o.Samples >= OutlierLatencySamples
+}
+
+// Decides which servers of a pool to eject, never ejecting more than the
+// maximum percentage of the pool (but always allowing one in pools of two or
+// more) so that a pool-wide problem doesn't leave it empty.
+type OutlierDetector struct {
+	sync.Mutex
+	consecutive5xx    int
+	consecutiveErrors int
+	latencyFactor     float64
+	ejectionTime      time.Duration
+	maxPercent        int
+}
+
+func NewOutlierDetector(config PoolConfig) *OutlierDetector {
+	detector := &OutlierDetector{
+		consecutive5xx:    config.OutlierConsecutive5xx,
+		consecutiveErrors: config.OutlierConsecutiveErrors,
+		latencyFactor:     config.OutlierLatencyFactor,
+		ejectionTime:      config.OutlierEjectionTime,
+		maxPercent:        config.OutlierMaxEjectionPercent,
+	}
+	if detector.ejectionTime == 0 {
+		detector.ejectionTime = DefaultEjectionTime
+	}
+	if detector.maxPercent == 0 {
+		detector.maxPercent = DefaultMaxEjectionPercent
+	}
+	return detector
+}
+
+func (d *OutlierDetector) Enabled() bool {
+	return d.consecutive5xx > 0 || d.consecutiveErrors > 0 || d.latencyFactor > 0
+}
+
+// Checks a server after it served a request. Must be called holding read lock
+// on pool.
+func (d *OutlierDetector) Check(pool string, server *Server, servers []*Server) {
+	server.Outlier.Lock()
+	errors, fives := server.Outlier.ConsecutiveErrors, server.Outlier.Consecutive5xx
+	server.Outlier.Unlock()
+
+	if d.consecutiveErrors > 0 && errors >= d.consecutiveErrors {
+		d.eject(pool, server, servers, "consecutive errors")
+	} else if d.consecutive5xx > 0 && fives >= d.consecutive5xx {
+		d.eject(pool, server, servers, "consecutive 5xx")
+	}
+}
+
+// Compares latencies across the pool, ejecting servers slower than the latency
+// factor times the median. Must be called holding read lock on pool.
+func (d *OutlierDetector) CheckLatency(pool string, servers []*Server) {
+	if d.latencyFactor <= 0 {
+		return
+	}
+
+	latencies := map[*Server]time.Duration{}
+	sorted := []time.Duration{}
+	for _, server := range servers {
+		if latency, ok := server.Outlier.latency(); ok && !server.Outlier.Ejected() {
+			latencies[server] = latency
+			sorted = append(sorted, latency)
+		}
+	}
+	// need a majority to call anyone an outlier
+	if len(sorted) < 3 {
+		return
+	}
+
+	sort.Sort(durations(sorted))
+	median := sorted[len(sorted)/2]
+	for server, latency := range latencies {
+		if float64(latency) > d.latencyFactor*float64(median) {
+			d.eject(pool, server, servers, "latency")
+		}
+	}
+}
+
+func (d *OutlierDetector) eject(pool string, server *Server, servers []*Server, reason string) {
+	// serialize ejections, so that concurrent ones can't exceed the maximum
+	d.Lock()
+	defer d.Unlock()
+
+	if server.Outlier.Ejected() {
+		return
+	}
+
+	ejected := 0
+	for _, other := range servers {
+		if other.Outlier.Ejected() {
+			ejected++
+		}
+	}
+	max := len(servers) * d.maxPercent / 100
+	if max < 1 && len(servers) > 1 {
+		max = 1
+	}
+	if ejected >= max {
+		logger.Printf("[pool %s] not ejecting %s for %s, %d of %d servers ejected", pool, server.Address,
+			reason, ejected, len(servers))
+		server.Outlier.spare()
+		return
+	}
+
+	duration := server.Outlier.eject(d.ejectionTime)
+	logger.Printf("[pool %s] ejected %s for %s for %s", pool, server.Address, reason, duration)
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
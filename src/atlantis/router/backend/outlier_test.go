@@ -0,0 +1,152 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/testutils"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var (
+	errResponse = ResponseError{nil, errors.New("connection refused")}
+	badResponse = ResponseError{&http.Response{StatusCode: 500}, nil}
+	okResponse  = ResponseError{&http.Response{StatusCode: 200}, nil}
+)
+
+func TestObserve(t *testing.T) {
+	server := NewServer("127.0.0.1:80")
+
+	server.Outlier.Observe(badResponse, 10*time.Millisecond)
+	server.Outlier.Observe(badResponse, 10*time.Millisecond)
+	if server.Outlier.Consecutive5xx != 2 || server.Outlier.ConsecutiveErrors != 0 {
+		t.Errorf("should count consecutive 5xx")
+	}
+
+	server.Outlier.Observe(errResponse, 10*time.Millisecond)
+	if server.Outlier.Consecutive5xx != 0 || server.Outlier.ConsecutiveErrors != 1 {
+		t.Errorf("should count consecutive errors")
+	}
+
+	server.Outlier.Observe(okResponse, 50*time.Millisecond)
+	if server.Outlier.Consecutive5xx != 0 || server.Outlier.ConsecutiveErrors != 0 {
+		t.Errorf("should reset on success")
+	}
+
+	if server.Outlier.Latency <= 10*time.Millisecond || server.Outlier.Latency >= 50*time.Millisecond {
+		t.Errorf("should average latency")
+	}
+}
+
+func TestCheckConsecutive(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk, StatusOk, StatusOk)
+	detector := NewOutlierDetector(PoolConfig{OutlierConsecutive5xx: 3, OutlierConsecutiveErrors: 2})
+
+	servers[0].Outlier.Observe(badResponse, 0)
+	servers[0].Outlier.Observe(badResponse, 0)
+	detector.Check("test", servers[0], servers)
+	if servers[0].Outlier.Ejected() {
+		t.Errorf("should not eject below threshold")
+	}
+
+	servers[0].Outlier.Observe(badResponse, 0)
+	detector.Check("test", servers[0], servers)
+	if !servers[0].Outlier.Ejected() || IsAvailable(servers[0]) {
+		t.Errorf("should eject after consecutive 5xx")
+	}
+
+	servers[1].Outlier.Observe(errResponse, 0)
+	servers[1].Outlier.Observe(errResponse, 0)
+	detector.Check("test", servers[1], servers)
+	if !servers[1].Outlier.Ejected() {
+		t.Errorf("should eject after consecutive errors")
+	}
+
+	servers[2].Outlier.Observe(errResponse, 0)
+	servers[2].Outlier.Observe(errResponse, 0)
+	detector.Check("test", servers[2], servers)
+	if servers[2].Outlier.Ejected() {
+		t.Errorf("should not eject more than max percent")
+	}
+	if servers[2].Outlier.ConsecutiveErrors != 0 {
+		t.Errorf("should restart counting for servers not ejected")
+	}
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	server := NewServer("127.0.0.1:80")
+
+	first := server.Outlier.eject(time.Second)
+	server.Outlier.EjectedUntil = time.Now()
+	second := server.Outlier.eject(time.Second)
+	if second != 2*first {
+		t.Errorf("should back off exponentially")
+	}
+
+	for i := 0; i < 8; i++ {
+		server.Outlier.EjectedUntil = time.Now()
+		server.Outlier.eject(time.Second)
+	}
+	if server.Outlier.EjectedUntil.Sub(time.Now()) > MaxEjectionMultiple*time.Second {
+		t.Errorf("should cap ejection time")
+	}
+
+	server.Outlier.EjectedUntil = time.Unix(0, 0)
+	if server.Outlier.eject(time.Second) != time.Second {
+		t.Errorf("should forget ejections after a while")
+	}
+}
+
+func TestCheckLatency(t *testing.T) {
+	servers := newTestServers(StatusOk, StatusOk, StatusOk, StatusOk)
+	detector := NewOutlierDetector(PoolConfig{OutlierLatencyFactor: 3})
+
+	for i := 0; i < OutlierLatencySamples; i++ {
+		servers[0].Outlier.Observe(okResponse, 100*time.Millisecond)
+		servers[1].Outlier.Observe(okResponse, 10*time.Millisecond)
+		servers[2].Outlier.Observe(okResponse, 12*time.Millisecond)
+		servers[3].Outlier.Observe(okResponse, 14*time.Millisecond)
+	}
+
+	detector.CheckLatency("test", servers)
+	if !servers[0].Outlier.Ejected() {
+		t.Errorf("should eject slow server")
+	}
+	for _, server := range servers[1:] {
+		if server.Outlier.Ejected() {
+			t.Errorf("should not eject servers near median")
+		}
+	}
+}
+
+func TestHandleEjects(t *testing.T) {
+	conf := newTestConfig()
+	conf.OutlierConsecutiveErrors = 1
+	pool := newTestPool(t, conf, "127.0.0.1:1", "127.0.0.1:2")
+
+	for i := 0; i < 2; i++ {
+		logRecord, _ := testutils.NewTestHAProxyLogRecord("http://127.0.0.1/")
+		pool.Handle(logRecord)
+	}
+
+	ejected := 0
+	for _, server := range pool.Servers {
+		if server.Outlier.Ejected() {
+			ejected++
+		}
+	}
+	if ejected != 1 {
+		t.Errorf("should eject failing server from pool, up to max percent")
+	}
+}
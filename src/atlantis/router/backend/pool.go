@@ -13,8 +13,14 @@ package backend
 
 import (
 	"atlantis/router/logger"
+	"atlantis/router/tracing"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,32 +29,118 @@ type PoolConfig struct {
 	HealthzTimeout time.Duration
 	RequestTimeout time.Duration
 	Status         string
+	SlowStart      time.Duration
+	SlowStartCurve string
+	Balancer       string
+	HashKey        string
+	StickyCookie   string
+	// Requests in flight before queueing, per pool and per server unless the
+	// server has its own limit
+	MaxConn       int
+	ServerMaxConn int
+	MaxQueueTime  time.Duration
+	// Time removed servers get to complete requests in flight
+	DrainTimeout time.Duration
+	// Upgraded connections tunneled at once, unlimited if zero, see Tunnel()
+	MaxTunnels        int
+	TunnelIdleTimeout time.Duration
+	// Flushing of responses to clients, see FlushInterval()
+	FlushInterval time.Duration
+	// Tuning of server transports, see NewTransport()
+	ConnectTimeout        time.Duration
+	KeepAlive             time.Duration
+	MaxIdleConns          int
+	IdleConnTimeout       time.Duration
+	ResponseHeaderTimeout time.Duration
+	DisableKeepAlives     bool
+	HTTP2                 bool
+	// PROXY protocol version sent to servers, none if empty
+	ProxyProtocol string
+	// TLS to servers, with client certificates for mutual TLS
+	TLS           bool
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+	TLSVerify     string
+	// Probing of servers, see HealthCheck
+	HealthzMode   string
+	HealthzPath   string
+	HealthzMethod string
+	HealthzHost   string
+	HealthzExpect string
+	HealthzBody   string
+	HealthzRise   int
+	HealthzFall   int
+	HealthzJitter int
+	// Service asked about by gRPC checks, the whole server if empty
+	HealthzService string
+	// Retries of failed requests on other servers
+	MaxAttempts        int
+	RetryOn            string
+	RetryNonIdempotent bool
+	RetryBudget        int
+	// Ejection of servers failing real traffic
+	OutlierConsecutive5xx     int
+	OutlierConsecutiveErrors  int
+	OutlierLatencyFactor      float64
+	OutlierEjectionTime       time.Duration
+	OutlierMaxEjectionPercent int
+	// Failing fast while the pool, or each server, errs too much
+	BreakerErrorRate   int
+	BreakerMinRequests int
+	BreakerWindow      time.Duration
+	BreakerOpenTime    time.Duration
+	BreakerServers     bool
 }
 
 type Pool struct {
-	Name    string
-	Dummy   bool
-	Servers map[string]*Server
-	Config  PoolConfig
-	killCh  chan bool
-	Metrics ConnectionMetrics
+	sync.RWMutex
+	Name     string
+	Dummy    bool
+	Servers  map[string]*Server
+	Config   PoolConfig
+	killCh   chan bool
+	Metrics  ConnectionMetrics
+	balancer Balancer
+	retry    *RetryPolicy
+	outlier  *OutlierDetector
+	breaker  *CircuitBreaker
+	check    *HealthCheck
+	queue    *Queue
+	draining map[*Server]bool
+	tunnels  int32
+	list     []*Server
+	sticky   map[string]*Server
 }
 
 func DummyPool(name string) *Pool {
 	return &Pool{
-		Name:  name,
-		Dummy: true,
+		Name:     name,
+		Dummy:    true,
+		balancer: NewBalancer(PoolConfig{}),
+		retry:    NewRetryPolicy(PoolConfig{}),
+		outlier:  NewOutlierDetector(PoolConfig{}),
 	}
 }
 
 func NewPool(name string, config PoolConfig) *Pool {
 	pool := &Pool{
-		Name:    name,
-		Dummy:   false,
-		Servers: map[string]*Server{},
-		Config:  config,
-		killCh:  make(chan bool),
-		Metrics: NewConnectionMetrics(),
+		Name:     name,
+		Dummy:    false,
+		Servers:  map[string]*Server{},
+		Config:   config,
+		killCh:   make(chan bool),
+		Metrics:  NewConnectionMetrics(),
+		balancer: NewBalancer(config),
+		retry:    NewRetryPolicy(config),
+		outlier:  NewOutlierDetector(config),
+		breaker:  NewCircuitBreaker(name, config),
+		check:    NewHealthCheck(config),
+		queue:    NewQueue(config.MaxConn),
+		draining: map[*Server]bool{},
+		list:     []*Server{},
+		sticky:   map[string]*Server{},
 	}
 
 	go pool.RunChecks()
@@ -63,33 +155,217 @@ func (p *Pool) Shutdown() {
 }
 
 func (p *Pool) AddServer(name string, server *Server) {
+	p.Lock()
+	defer p.Unlock()
+
 	if _, ok := p.Servers[name]; ok {
 		logger.Errorf("[pool %s] server %s exists", p.Name, name)
 		return
 	}
 	p.Servers[name] = server
+	p.setBreaker(server)
+	p.configureServer(server)
+	p.updateList()
 }
 
 func (p *Pool) DelServer(name string) {
-	if _, ok := p.Servers[name]; !ok {
+	p.Lock()
+	defer p.Unlock()
+
+	server, ok := p.Servers[name]
+	if !ok {
 		logger.Errorf("[pool %s] server %s absent", p.Name, name)
 		return
 	}
 
 	delete(p.Servers, name)
+	p.updateList()
+	p.startDrain(server)
+}
+
+// Removed servers get no new requests, but requests in flight are given until
+// the drain timeout to complete before they are cancelled. Either way, the
+// server's connections are closed after. Must be called holding write lock on
+// pool.
+func (p *Pool) startDrain(server *Server) {
+	timeout := p.Config.DrainTimeout
+	if timeout == 0 {
+		timeout = DefaultDrainTimeout
+	}
+
+	p.draining[server] = true
+	go func() {
+		if !server.Drain(timeout) {
+			logger.Printf("[pool %s] server %s drain timed out, cancelled requests in flight", p.Name, server.Address)
+		}
+		server.transport().CloseIdleConnections()
+
+		p.Lock()
+		delete(p.draining, server)
+		p.Unlock()
+		logger.Printf("[pool %s] server %s drained", p.Name, server.Address)
+	}()
+}
+
+// Servers in service, in stable order. Unlike Servers, safe to use while the
+// pool is being updated.
+func (p *Pool) ServerList() []*Server {
+	p.RLock()
+	defer p.RUnlock()
+
+	// never modified in place, see updateList()
+	return p.list
+}
+
+// Servers which were removed but still have requests in flight.
+func (p *Pool) Draining() []*Server {
+	p.RLock()
+	defer p.RUnlock()
+
+	draining := make([]*Server, 0, len(p.draining))
+	for server := range p.draining {
+		draining = append(draining, server)
+	}
+	return draining
+}
+
+// Requests in flight hold on to the old server and complete normally. When the
+// address is unchanged, the existing server is reconfigured instead so that its
+// status, metrics and keep-alive connections carry over.
+func (p *Pool) UpdateServer(name string, server *Server) {
+	p.Lock()
+	defer p.Unlock()
+
+	old, ok := p.Servers[name]
+	if !ok {
+		logger.Printf("[pool %s] server %s absent, adding", p.Name, name)
+		p.Servers[name] = server
+		p.setBreaker(server)
+		p.configureServer(server)
+		p.updateList()
+		return
+	}
+
+	if old.Address == server.Address {
+		old.Config = server.Config
+		p.configureServer(old)
+		// weights may have changed
+		p.updateList()
+		return
+	}
+
+	logger.Printf("[pool %s] server %s moved from %s to %s", p.Name, name, old.Address, server.Address)
+	p.Servers[name] = server
+	p.setBreaker(server)
+	p.configureServer(server)
+	p.updateList()
+
+	// don't wait for the next check to put the new address in service
+	go server.CheckHealth(p.check, p.Config.HealthzTimeout)
+	p.startDrain(old)
+}
+
+// Balancers index into the server list, so keep it in a stable order instead
+// of relying on map iteration. Must be called holding write lock on pool.
+func (p *Pool) updateList() {
+	names := make([]string, 0, len(p.Servers))
+	for name := range p.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]*Server, len(names))
+	sticky := make(map[string]*Server, len(names))
+	for i, name := range names {
+		list[i] = p.Servers[name]
+		sticky[StickyValue(list[i])] = list[i]
+	}
+	p.list, p.sticky = list, sticky
 }
 
 func (p *Pool) Reconfigure(config PoolConfig) {
+	p.Lock()
+	defer p.Unlock()
+
+	if config.Balancer != p.Config.Balancer || config.HashKey != p.Config.HashKey {
+		logger.Printf("[pool %s] balancer changed to %s %s", p.Name, config.Balancer, config.HashKey)
+		p.balancer = NewBalancer(config)
+	}
+	if config.MaxAttempts != p.Config.MaxAttempts || config.RetryOn != p.Config.RetryOn ||
+		config.RetryNonIdempotent != p.Config.RetryNonIdempotent || config.RetryBudget != p.Config.RetryBudget {
+		p.retry = NewRetryPolicy(config)
+	}
+	p.outlier = NewOutlierDetector(config)
+	p.check = NewHealthCheck(config)
+	// keep breaker states unless their config changed
+	breakerChanged := config.BreakerErrorRate != p.Config.BreakerErrorRate ||
+		config.BreakerMinRequests != p.Config.BreakerMinRequests || config.BreakerWindow != p.Config.BreakerWindow ||
+		config.BreakerOpenTime != p.Config.BreakerOpenTime || config.BreakerServers != p.Config.BreakerServers
+	if transportChanged(config, p.Config) {
+		logger.Printf("[pool %s] transport changed", p.Name)
+		for _, server := range p.Servers {
+			server.setTransport(NewTransport(config), config.RequestTimeout)
+		}
+	}
 	p.Config = config
+	p.queue.SetMax(config.MaxConn)
+	if breakerChanged {
+		p.breaker = NewCircuitBreaker(p.Name, config)
+		for _, server := range p.Servers {
+			p.setBreaker(server)
+		}
+	}
+	for _, server := range p.Servers {
+		p.configureServer(server)
+	}
+}
+
+// Must be called holding write lock on pool.
+func (p *Pool) setBreaker(server *Server) {
+	server.Breaker = nil
+	if p.Config.BreakerServers {
+		server.Breaker = NewCircuitBreaker(p.Name+" "+server.Address, p.Config)
+	}
+}
+
+// Applies pool config which servers keep themselves. Must be called holding
+// write lock on pool.
+func (p *Pool) configureServer(server *Server) {
+	server.Status.SlowStart = p.Config.SlowStart
+	server.Status.SlowStartCurve = p.Config.SlowStartCurve
+
+	maxConn := server.Config.MaxConn
+	if maxConn == 0 {
+		maxConn = p.Config.ServerMaxConn
+	}
+	server.Queue.SetMax(maxConn)
+}
+
+// State of the pool-wide circuit breaker, CLOSED when there is none.
+func (p *Pool) BreakerState() string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.breaker.State()
 }
 
 func (p *Pool) RunChecks() {
 	for {
 		select {
 		case <-time.After(p.Config.HealthzEvery):
-			for _, server := range p.Servers {
-				go server.CheckStatus(p.Config.HealthzTimeout)
+			p.RLock()
+			// spread probes over part of the interval rather than all at once
+			spread := int64(p.Config.HealthzEvery) * int64(p.Config.HealthzJitter) / 100
+			for _, server := range p.list {
+				server, check, tout := server, p.check, p.Config.HealthzTimeout
+				delay := time.Duration(0)
+				if spread > 0 {
+					delay = time.Duration(rand.Int63n(spread))
+				}
+				time.AfterFunc(delay, func() { server.CheckHealth(check, tout) })
 			}
+			p.outlier.CheckLatency(p.Name, p.list)
+			p.RUnlock()
 		case <-p.killCh:
 			logger.Debugf("[pool %s] stopping checks", p.Name)
 			return
@@ -97,43 +373,226 @@ func (p *Pool) RunChecks() {
 	}
 }
 
-func (p Pool) Next() *Server {
-	var next *Server
-	var cost uint32 = 0xffffffff
+// Requests queue for a server only when every available server is saturated,
+// and then for the one with the shortest queue.
+func (p *Pool) Next(req *http.Request) *Server {
+	p.RLock()
+	defer p.RUnlock()
 
-	for _, server := range p.Servers {
-		// Never send traffic to servers under maintenance or unknown.
-		if strings.EqualFold(server.Status.Current, StatusMaintenance) || strings.EqualFold(server.Status.Current, StatusUnknown) {
-			continue
-		}
+	if server := p.balancer.Next(p.list, p.Config.Status, req); server != nil {
+		return server
+	}
+	return shortestQueue(p.list)
+}
 
-		newCost := server.Cost(p.Config.Status)
-		if newCost < cost {
-			next, cost = server, newCost
-		}
+// Affinity cookies identify servers by a hash of their address, so that
+// cookies survive router restarts without exposing backend addresses.
+func StickyValue(server *Server) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(server.Address)))
+}
+
+// Returns the server named by the request's affinity cookie, if it is still in
+// the pool and neither under maintenance nor critical.
+func (p *Pool) stickyServer(req *http.Request, name string) *Server {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return nil
+	}
+
+	p.RLock()
+	server := p.sticky[cookie.Value]
+	p.RUnlock()
+
+	if server == nil || !IsAvailable(server) || strings.EqualFold(server.Status.Current, StatusCritical) {
+		return nil
+	}
+	return server
+}
+
+// Picks the server for a request, keeping clients on their server when the
+// pool is sticky. Returns nil if no server is available.
+func (p *Pool) pick(logRecord *logger.HAProxyLogRecord, sticky string) *Server {
+	var server *Server
+	if sticky != "" {
+		server = p.stickyServer(logRecord.Request, sticky)
+	}
+	if server == nil {
+		server = p.Next(logRecord.Request)
 	}
+	return server
+}
 
-	return next
+// Pins the client to server with the affinity cookie, unless it already is.
+func stick(logRecord *logger.HAProxyLogRecord, sticky string, server *Server) {
+	if cookie, err := logRecord.Request.Cookie(sticky); err != nil || cookie.Value != StickyValue(server) {
+		c := &http.Cookie{Name: sticky, Value: StickyValue(server), Path: "/", HttpOnly: true}
+		logRecord.AddResponseHeader("Set-Cookie", c.String())
+	}
 }
+
+// Wraps the retry decision of an attempt so that clients of sticky pools are
+// pinned to the server which answers in the end, not to one failed over from.
+func stickOnAnswer(logRecord *logger.HAProxyLogRecord, sticky string, server *Server,
+	retry func(ResponseError) bool) func(ResponseError) bool {
+	if sticky == "" {
+		return retry
+	}
+	return func(resErr ResponseError) bool {
+		if retry != nil && retry(resErr) {
+			return true
+		}
+		if resErr.Error == nil {
+			stick(logRecord, sticky, server)
+		}
+		return false
+	}
+}
+
 func (p *Pool) Handle(logRecord *logger.HAProxyLogRecord) {
 	pTime := time.Now()
 	if p.Dummy {
-		logger.Printf("[pool %s] Dummy", p.Name)
+		logRecord.Printf("[pool %s] Dummy", p.Name)
 		logRecord.Error(logger.BadGatewayMsg, http.StatusBadGateway)
 		logRecord.Terminate("Pool: " + logger.BadGatewayMsg)
 		return
 	}
+	if err := CheckFraming(logRecord.Request); err != nil {
+		logRecord.Debugf("[pool %s] rejected request: %s", p.Name, err)
+		logRecord.Error(logger.BadRequestMsg, http.StatusBadRequest)
+		logRecord.Terminate("Pool: " + logger.BadRequestMsg)
+		return
+	}
 	p.Metrics.ConnectionStart()
 	defer p.Metrics.ConnectionDone()
 
-	server := p.Next()
+	p.RLock()
+	retry, outlier, breaker := p.retry, p.outlier, p.breaker
+	maxQueueTime, proxyProtocol := p.Config.MaxQueueTime, p.Config.ProxyProtocol
+	sticky := p.Config.StickyCookie
+	tout, flush := p.Config.RequestTimeout, p.Config.FlushInterval
+	p.RUnlock()
+	if !breaker.Allow() {
+		logRecord.Debugf("[pool %s] circuit open", p.Name)
+		logRecord.Error(logger.ServiceUnavailableMsg, http.StatusServiceUnavailable)
+		logRecord.Terminate("Pool: circuit open")
+		return
+	}
+	if proxyProtocol != "" {
+		logRecord.Request = withClientAddr(logRecord.Request)
+	}
+	if IsUpgrade(logRecord.Request) {
+		status := p.tunnel(logRecord, pTime)
+		breaker.Record(status < 500)
+		return
+	}
+
+	// time in the pool and server queues counts against the same limit
+	if maxQueueTime == 0 {
+		maxQueueTime = DefaultMaxQueueTime
+	}
+	deadline := time.Now().Add(maxQueueTime)
+	span := tracing.FromContext(logRecord.Request.Context())
+	queueing := span.Child("pool queue", tracing.SpanKindInternal)
+	backendQueue, ok := p.queue.Acquire(maxQueueTime)
+	queueing.SetAttribute("queue.position", backendQueue)
+	queueing.Finish()
+	if !ok {
+		logRecord.Debugf("[pool %s] queue timeout", p.Name)
+		logRecord.PoolUpdateRecord(p.Name, p.Metrics.GetActiveConnections(), uint64(backendQueue), pTime)
+		logRecord.Error(logger.ServiceUnavailableMsg, http.StatusServiceUnavailable)
+		logRecord.Terminate("Pool: queue timeout")
+		breaker.Record(false)
+		return
+	}
+	defer p.queue.Release()
+
+	tried := map[*Server]bool{}
+	server := p.allow(logRecord.Request, p.pick(logRecord, sticky), tried)
 	if server == nil {
 		// reachable when all servers in pool report StatusMaintenance
-		logger.Printf("[pool %s] no server", p.Name)
+		logRecord.Printf("[pool %s] no server", p.Name)
 		logRecord.Error(logger.ServiceUnavailableMsg, http.StatusServiceUnavailable)
 		logRecord.Terminate("Pool: " + logger.ServiceUnavailableMsg)
+		breaker.Record(false)
 		return
 	}
-	logRecord.PoolUpdateRecord(p.Name, p.Metrics.GetActiveConnections(), p.Metrics.GetTotalConnections(), pTime)
-	server.Handle(logRecord, p.Config.RequestTimeout)
+	logRecord.PoolUpdateRecord(p.Name, p.Metrics.GetActiveConnections(), uint64(backendQueue), pTime)
+	retry.Deposit()
+
+	for attempt := 0; ; attempt++ {
+		var next *Server
+		var canRetry func(ResponseError) bool
+		if retry.Retryable(logRecord.Request, attempt) {
+			tried[server] = true
+			if next = p.nextUntried(logRecord.Request, tried); next != nil {
+				canRetry = retry.Retry
+			}
+		}
+		queueing = span.Child("server queue", tracing.SpanKindInternal)
+		queueing.SetAttribute("server.address", server.Address)
+		srvQueue, ok := server.Queue.Acquire(deadline.Sub(time.Now()))
+		queueing.SetAttribute("queue.position", srvQueue)
+		queueing.Finish()
+		if !ok {
+			logRecord.Debugf("[server %s] queue timeout", server.Address)
+			server.Breaker.Record(false)
+			logRecord.ServerUpdateRecord(server.Address, uint64(srvQueue), server.Metrics.Cost(), time.Now())
+			logRecord.Error(logger.ServiceUnavailableMsg, http.StatusServiceUnavailable)
+			logRecord.Terminate("Server: queue timeout")
+			breaker.Record(false)
+			return
+		}
+		canRetry = stickOnAnswer(logRecord, sticky, server, canRetry)
+		retried := server.TryHandle(logRecord, tout, flush, uint64(srvQueue), canRetry)
+		server.Queue.Release()
+		if outlier.Enabled() {
+			p.RLock()
+			outlier.Check(p.Name, server, p.list)
+			p.RUnlock()
+		}
+		if !retried {
+			status := ResponseStatus(logRecord.GetResponseStatusCode(), logRecord.GetResponseHeaders(),
+				logRecord.GetResponseTrailers())
+			breaker.Record(status < 500)
+			return
+		}
+		logRecord.Retry()
+		if server = p.allow(logRecord.Request, next, tried); server == nil {
+			logRecord.Printf("[pool %s] no server to retry on", p.Name)
+			logRecord.Error(logger.ServiceUnavailableMsg, http.StatusServiceUnavailable)
+			logRecord.Terminate("Pool: " + logger.ServiceUnavailableMsg)
+			breaker.Record(false)
+			return
+		}
+	}
+}
+
+// Servers only get requests their breaker allows, limiting half-open ones to
+// their probes; when server's doesn't, the cheapest untried server whose
+// breaker does gets the request instead. Returns nil if there is none.
+func (p *Pool) allow(req *http.Request, server *Server, tried map[*Server]bool) *Server {
+	for server != nil && !server.Breaker.Allow() {
+		tried[server] = true
+		server = p.nextUntried(req, tried)
+	}
+	return server
+}
+
+// Retries go to the cheapest server not tried yet, rather than through the
+// balancer, which may well pick the same server again.
+func (p *Pool) nextUntried(req *http.Request, tried map[*Server]bool) *Server {
+	p.RLock()
+	defer p.RUnlock()
+
+	untried := make([]*Server, 0, len(p.list))
+	for _, server := range p.list {
+		if !tried[server] {
+			untried = append(untried, server)
+		}
+	}
+
+	if server := (&LeastConnBalancer{}).Next(untried, p.Config.Status, req); server != nil {
+		return server
+	}
+	return shortestQueue(untried)
 }
@@ -12,9 +12,15 @@
 package backend
 
 import (
+	"atlantis/router/logger"
 	"atlantis/router/testutils"
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"regexp"
 	"testing"
 	"time"
 )
@@ -28,6 +34,21 @@ func newTestConfig() PoolConfig {
 	}
 }
 
+// newTestPool serves servers at the addresses, up and warmed up from the
+// start and not health checked again during the test, and shuts the pool
+// down when the test ends.
+func newTestPool(t *testing.T, conf PoolConfig, addresses ...string) *Pool {
+	conf.HealthzEvery = time.Minute
+	pool := NewPool("test", conf)
+	t.Cleanup(pool.Shutdown)
+	for _, address := range addresses {
+		pool.AddServer(address, NewServer(address))
+		pool.Servers[address].Status.Set(StatusOk)
+		pool.Servers[address].Status.Changed = time.Unix(0, 0)
+	}
+	return pool
+}
+
 func TestDummyPool(t *testing.T) {
 	pool := DummyPool("dummy")
 	defer pool.Shutdown()
@@ -93,6 +114,93 @@ func TestDelServer(t *testing.T) {
 	}
 }
 
+func TestDelServerDrain(t *testing.T) {
+	conf := newTestConfig()
+	conf.RequestTimeout = 1 * time.Second
+	backend := testutils.NewBackend(100, false)
+	defer backend.Shutdown()
+	pool := newTestPool(t, conf, backend.Address())
+	server := pool.Servers[backend.Address()]
+
+	done := make(chan int)
+	go func() {
+		logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+		pool.Handle(logRecord)
+		done <- rr.Code
+	}()
+	for server.Metrics.Cost() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	pool.DelServer(backend.Address())
+	if draining := pool.Draining(); len(draining) != 1 || draining[0] != server {
+		t.Errorf("should drain deleted server")
+	}
+	if pool.Next(nil) != nil {
+		t.Errorf("should not send new requests to draining server")
+	}
+	if <-done != http.StatusOK {
+		t.Errorf("should complete requests in flight")
+	}
+
+	time.Sleep(2 * drainPollInterval)
+	if len(pool.Draining()) != 0 {
+		t.Errorf("should be done draining")
+	}
+}
+
+func TestUpdateServer(t *testing.T) {
+	pool := NewPool("test", newTestConfig())
+	defer pool.Shutdown()
+
+	pool.AddServer("host0", NewServer("127.0.0.1:80"))
+	old := pool.Servers["host0"]
+	old.Status.Set(StatusOk)
+	old.Metrics.RequestStart()
+
+	server := NewServer("127.0.0.1:80")
+	server.Config.Weight = 2 * DefaultWeight
+	pool.UpdateServer("host0", server)
+	if pool.Servers["host0"] != old || old.Config.Weight != 2*DefaultWeight {
+		t.Errorf("should reconfigure server in place for same address")
+	}
+	if old.Status.Current != StatusOk || old.Metrics.RequestsInFlight != 1 {
+		t.Errorf("should carry over status and metrics")
+	}
+
+	server = NewServer("127.0.0.1:81")
+	pool.UpdateServer("host0", server)
+	if pool.Servers["host0"] != server || pool.Next(nil) == old {
+		t.Errorf("should replace server for new address")
+	}
+	if len(pool.Servers) != 1 {
+		t.Errorf("should not add servers on update")
+	}
+
+	pool.UpdateServer("host1", NewServer("127.0.0.1:82"))
+	if pool.Servers["host1"] == nil {
+		t.Errorf("should add absent servers")
+	}
+}
+
+func TestSlowStartConfig(t *testing.T) {
+	conf := newTestConfig()
+	conf.SlowStart, conf.SlowStartCurve = 5*time.Minute, SlowStartLinear
+	pool := NewPool("test", conf)
+	defer pool.Shutdown()
+
+	server := NewServer("127.0.0.1:80")
+	pool.AddServer("test", server)
+	if server.Status.SlowStart != 5*time.Minute || server.Status.SlowStartCurve != SlowStartLinear {
+		t.Errorf("should apply slow start to added servers")
+	}
+
+	pool.Reconfigure(newTestConfig())
+	if server.Status.SlowStart != 0 || server.Status.SlowStartCurve != "" {
+		t.Errorf("should apply slow start on reconfigure")
+	}
+}
+
 func TestReconfigure(t *testing.T) {
 	pool := NewPool("test", PoolConfig{})
 	defer pool.Shutdown()
@@ -133,6 +241,41 @@ func TestRunChecks(t *testing.T) {
 	}
 }
 
+func TestRunChecksJitter(t *testing.T) {
+	conf := newTestConfig()
+	conf.HealthzEvery = 50 * time.Millisecond
+	conf.HealthzJitter = 100
+	pool := NewPool("test", conf)
+	defer pool.Shutdown()
+
+	backends := []*testutils.Backend{}
+	for i := 0; i < 10; i++ {
+		backend := testutils.NewBackend(0, false)
+		defer backend.Shutdown()
+		backend.SetStatus(http.StatusOK, "OK")
+		pool.AddServer(backend.Address(), NewServer(backend.Address()))
+		backends = append(backends, backend)
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	var earliest, latest time.Time
+	for _, backend := range backends {
+		if backend.Handler.Recorded.Len() == 0 {
+			t.Fatalf("should check every server within the interval")
+		}
+		first := backend.Handler.Recorded.Front().Value.(testutils.RequestAndTime).T
+		if earliest.IsZero() || first.Before(earliest) {
+			earliest = first
+		}
+		if first.After(latest) {
+			latest = first
+		}
+	}
+	if latest.Sub(earliest) < 10*time.Millisecond {
+		t.Errorf("should spread checks over the interval")
+	}
+}
+
 func TestNextMaintenance(t *testing.T) {
 	pool := NewPool("test", newTestConfig())
 	defer pool.Shutdown()
@@ -150,7 +293,7 @@ func TestNextMaintenance(t *testing.T) {
 	pool.AddServer(backend1.Address(), NewServer(backend1.Address()))
 	time.Sleep(50 * time.Millisecond)
 
-	if pool.Next() != nil {
+	if pool.Next(nil) != nil {
 		t.Errorf("should never return server under maintenance")
 	}
 }
@@ -177,7 +320,7 @@ func TestNextCost(t *testing.T) {
 		}
 	}
 
-	if pool.Next().Address != backend1.Address() {
+	if pool.Next(nil).Address != backend1.Address() {
 		t.Errorf("should return server with least cost")
 	}
 }
@@ -230,3 +373,299 @@ func TestHandle(t *testing.T) {
 		t.Errorf("%d | %d | %s", logRecord.GetResponseStatusCode, rr.Code, string(body))
 	}
 }
+
+// Requests seen by backend, not counting health checks.
+func countRequests(backend *testutils.Backend) int {
+	count := 0
+	for e := backend.Handler.Recorded.Front(); e != nil; e = e.Next() {
+		if e.Value.(testutils.RequestAndTime).R.URL.Path != "/healthz" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestHandleSticky(t *testing.T) {
+	conf := newTestConfig()
+	conf.StickyCookie = "ROUTERID"
+	backend0 := testutils.NewBackend(0, false)
+	defer backend0.Shutdown()
+	backend1 := testutils.NewBackend(0, false)
+	defer backend1.Shutdown()
+	pool := newTestPool(t, conf, backend0.Address(), backend1.Address())
+
+	server := pool.Servers[backend1.Address()]
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend1.URL())
+	logRecord.Request.AddCookie(&http.Cookie{Name: "ROUTERID", Value: StickyValue(server)})
+	for _, other := range pool.Servers {
+		if other != server {
+			// would be preferred by least cost
+			server.Metrics.RequestStart()
+			defer server.Metrics.RequestDone()
+		}
+	}
+	pool.Handle(logRecord)
+
+	if countRequests(backend1) != 1 {
+		t.Errorf("should route to server named by cookie")
+	}
+	if rr.Header().Get("Set-Cookie") != "" {
+		t.Errorf("should not reissue matching cookie")
+	}
+
+	server.Status.Set(StatusCritical)
+	logRecord, rr = testutils.NewTestHAProxyLogRecord(backend1.URL())
+	logRecord.Request.AddCookie(&http.Cookie{Name: "ROUTERID", Value: StickyValue(server)})
+	pool.Handle(logRecord)
+
+	if countRequests(backend1) != 1 || countRequests(backend0) != 1 {
+		t.Errorf("should fall back to balancer when server is critical")
+	}
+	cookie := rr.Header().Get("Set-Cookie")
+	if cookie != "ROUTERID="+StickyValue(pool.Servers[backend0.Address()])+"; Path=/; HttpOnly" {
+		t.Errorf("should set cookie for newly chosen server")
+		t.Errorf("%s", cookie)
+	}
+}
+
+func TestHandleRetry(t *testing.T) {
+	conf := newTestConfig()
+	conf.MaxAttempts = 2
+	dead := testutils.NewBackend(0, false)
+	dead.Shutdown()
+	backend := testutils.NewBackend(0, false)
+	defer backend.Shutdown()
+	backend.SetResponse(http.StatusOK, "Second time lucky!")
+	pool := newTestPool(t, conf, dead.Address(), backend.Address())
+	// so that the dead server is tried first
+	pool.Servers[backend.Address()].Metrics.RequestStart()
+
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+	pool.Handle(logRecord)
+
+	body, _ := ioutil.ReadAll(rr.Body)
+	if rr.Code != http.StatusOK || string(body) != "Second time lucky!" {
+		t.Errorf("should retry on another server")
+	}
+	if logRecord.Retries() != 1 {
+		t.Errorf("should count retries")
+	}
+	if len(logRecord.Request.Header["X-Forwarded-For"]) != 1 {
+		t.Errorf("should set x-forwarded-for once")
+	}
+
+	pool.Reconfigure(newTestConfig())
+	pool.Servers[backend.Address()].Metrics.RequestStart()
+	logRecord, rr = testutils.NewTestHAProxyLogRecord(backend.URL())
+	pool.Handle(logRecord)
+
+	if rr.Code != http.StatusBadGateway || logRecord.Retries() != 0 {
+		t.Errorf("should not retry unless configured")
+	}
+}
+
+func TestHandleStickyRetry(t *testing.T) {
+	conf := newTestConfig()
+	conf.MaxAttempts = 2
+	conf.StickyCookie = "ROUTERID"
+	dead := testutils.NewBackend(0, false)
+	dead.Shutdown()
+	backend := testutils.NewBackend(0, false)
+	defer backend.Shutdown()
+	pool := newTestPool(t, conf, dead.Address(), backend.Address())
+	// so that the dead server is tried first
+	pool.Servers[backend.Address()].Metrics.RequestStart()
+
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+	pool.Handle(logRecord)
+
+	cookies := rr.Header()["Set-Cookie"]
+	expected := "ROUTERID=" + StickyValue(pool.Servers[backend.Address()]) + "; Path=/; HttpOnly"
+	if logRecord.Retries() != 1 || len(cookies) != 1 || cookies[0] != expected {
+		t.Errorf("should pin client to server answering after retry, got %v", cookies)
+	}
+}
+
+func TestHandleQueue(t *testing.T) {
+	conf := newTestConfig()
+	conf.RequestTimeout = 1 * time.Second
+	conf.ServerMaxConn = 1
+	conf.MaxQueueTime = 100 * time.Millisecond
+	backend := testutils.NewBackend(80, false)
+	defer backend.Shutdown()
+	pool := newTestPool(t, conf, backend.Address())
+
+	// one in flight, one through the queue in time and two timing out
+	codes := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+			pool.Handle(logRecord)
+			codes <- rr.Code
+		}()
+	}
+
+	ok, unavailable := 0, 0
+	for i := 0; i < 4; i++ {
+		switch <-codes {
+		case http.StatusOK:
+			ok++
+		case http.StatusServiceUnavailable:
+			unavailable++
+		}
+	}
+	if ok != 2 || unavailable != 2 {
+		t.Errorf("should queue requests beyond max conn")
+	}
+	if backend.Handler.Recorded.Len() != ok {
+		t.Errorf("should not send requests timing out in queue")
+	}
+}
+
+// Queue and total times, tw and tt, of the logged request with status.
+func loggedTimes(out string, status int) (tw, tt string) {
+	pattern := fmt.Sprintf(` -?\d+/(-?\d+)/-?\d+/-?\d+/(-?\d+) %d `, status)
+	if match := regexp.MustCompile(pattern).FindStringSubmatch(out); match != nil {
+		return match[1], match[2]
+	}
+	return "", ""
+}
+
+func TestHandleQueueSaturated(t *testing.T) {
+	conf := newTestConfig()
+	conf.RequestTimeout = 1 * time.Second
+	conf.Balancer = BalanceHash
+	conf.HashKey = HashKeyPath
+	conf.ServerMaxConn = 1
+	backend0 := testutils.NewBackend(100, false)
+	defer backend0.Shutdown()
+	backend1 := testutils.NewBackend(100, false)
+	defer backend1.Shutdown()
+	pool := newTestPool(t, conf, backend0.Address(), backend1.Address())
+
+	// same key, so the same server unless it is saturated; the third request
+	// queues once both are
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			logRecord, rr := testutils.NewTestHAProxyLogRecord(backend0.URL() + "/key")
+			pool.Handle(logRecord)
+			codes <- rr.Code
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("should serve all requests, got %d", code)
+		}
+	}
+	if countRequests(backend0)+countRequests(backend1) != 3 || countRequests(backend0) == 0 ||
+		countRequests(backend1) == 0 {
+		t.Errorf("should pass over saturated server")
+	}
+}
+
+func TestHandleQueueTimeoutLog(t *testing.T) {
+	conf := newTestConfig()
+	conf.RequestTimeout = 1 * time.Second
+	conf.MaxConn = 1
+	conf.MaxQueueTime = 50 * time.Millisecond
+	backend := testutils.NewBackend(150, false)
+	defer backend.Shutdown()
+	pool := newTestPool(t, conf, backend.Address())
+
+	done := make(chan bool)
+	go func() {
+		logRecord, _ := testutils.NewTestHAProxyLogRecord(backend.URL())
+		pool.Handle(logRecord)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	var out bytes.Buffer
+	req, _ := http.NewRequest("GET", backend.URL(), nil)
+	logRecord := logger.NewShallowHAProxyLogRecord(nil, httptest.NewRecorder(), req)
+	logRecord.SetLogger(log.New(&out, "", 0))
+	pool.Handle(logRecord)
+	<-done
+
+	tw, tt := loggedTimes(out.String(), http.StatusServiceUnavailable)
+	if tw == "" || tw[0] == '-' || tt[0] == '-' {
+		t.Errorf("should log times of requests timing out in pool queue, got %s", out.String())
+	}
+}
+
+func TestHandleBreaker(t *testing.T) {
+	conf := newTestConfig()
+	conf.BreakerErrorRate = 50
+	conf.BreakerMinRequests = 2
+	conf.BreakerServers = true
+	backend := testutils.NewBackend(0, false)
+	defer backend.Shutdown()
+	backend.SetResponse(http.StatusInternalServerError, "Overloaded!")
+	pool := newTestPool(t, conf, backend.Address())
+	if pool.Servers[backend.Address()].Breaker == nil {
+		t.Errorf("should set server breakers when configured")
+	}
+
+	for i := 0; i < 2; i++ {
+		logRecord, _ := testutils.NewTestHAProxyLogRecord(backend.URL())
+		pool.Handle(logRecord)
+	}
+	if pool.BreakerState() != BreakerOpen {
+		t.Errorf("should open pool breaker on errors")
+	}
+
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+	pool.Handle(logRecord)
+	if rr.Code != http.StatusServiceUnavailable || countRequests(backend) != 2 {
+		t.Errorf("should fail fast while open")
+	}
+
+	pool.Reconfigure(newTestConfig())
+	if pool.BreakerState() != BreakerClosed || pool.Servers[backend.Address()].Breaker != nil {
+		t.Errorf("should drop breakers when unconfigured")
+	}
+}
+
+func TestHandleServerBreakerProbes(t *testing.T) {
+	conf := newTestConfig()
+	conf.RequestTimeout = 1 * time.Second
+	conf.BreakerErrorRate = 50
+	conf.BreakerMinRequests = 2
+	conf.BreakerOpenTime = 50 * time.Millisecond
+	conf.BreakerServers = true
+	backend := testutils.NewBackend(100, false)
+	defer backend.Shutdown()
+	pool := newTestPool(t, conf, backend.Address())
+	server := pool.Servers[backend.Address()]
+	server.Breaker.Record(false)
+	server.Breaker.Record(false)
+	time.Sleep(60 * time.Millisecond)
+	if server.Breaker.State() != BreakerHalfOpen {
+		t.Fatalf("should half open server breaker")
+	}
+
+	codes := make(chan int, BreakerProbes+2)
+	for i := 0; i < BreakerProbes+2; i++ {
+		go func() {
+			logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+			pool.Handle(logRecord)
+			codes <- rr.Code
+		}()
+	}
+
+	unavailable := 0
+	for i := 0; i < BreakerProbes+2; i++ {
+		if <-codes == http.StatusServiceUnavailable {
+			unavailable++
+		}
+	}
+	if unavailable != 2 || countRequests(backend) != BreakerProbes {
+		t.Errorf("should let only probes through to half open server, got %d requests", countRequests(backend))
+	}
+	if server.Breaker.State() != BreakerClosed {
+		t.Errorf("should close server breaker after successful probes")
+	}
+}
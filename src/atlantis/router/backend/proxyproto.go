@@ -0,0 +1,409 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/logger"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions sent to servers, see WriteProxyHeader().
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// Time trusted clients get to send the PROXY header.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+const (
+	proxyV1MaxLen  = 107
+	proxyV2Version = 0x20
+	proxyV2Local   = 0x00
+	proxyV2Proxy   = 0x01
+	proxyV2TCP4    = 0x11
+	proxyV2TCP6    = 0x21
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func IsValidProxyProtocol(version string) bool {
+	switch strings.ToLower(version) {
+	case ProxyProtocolV1, ProxyProtocolV2:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadProxyHeader reads a PROXY protocol v1 or v2 header, returning the
+// addresses of the client and of the proxy it connected to. Both are nil when
+// the proxy speaks for itself (UNKNOWN and LOCAL) or for non-TCP clients.
+func ReadProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, nil, errors.New("no PROXY header")
+}
+
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) <= proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("bad PROXY v1 header %q", line)
+	}
+	srcAddr, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != (proto == "TCP4") {
+		return nil, fmt.Errorf("bad PROXY v1 address %s", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad PROXY v1 port %s", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0xf0 != proxyV2Version {
+		return nil, nil, fmt.Errorf("bad PROXY v2 version %#x", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("bad PROXY v2 command %#x", header[12]&0x0f)
+	}
+
+	var size int
+	switch header[13] {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// UDP and unix sockets are of no use as client addresses
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("short PROXY v2 addresses")
+	}
+	srcAddr := &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	dstAddr := &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return srcAddr, dstAddr, nil
+}
+
+// WriteProxyHeader sends the addresses of a proxied connection in the given
+// PROXY protocol version, or that the connection is the proxy's own unless
+// both are TCP addresses of the same family.
+func WriteProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcAddr, _ := src.(*net.TCPAddr)
+	dstAddr, _ := dst.(*net.TCPAddr)
+	known := srcAddr != nil && dstAddr != nil && (srcAddr.IP.To4() != nil) == (dstAddr.IP.To4() != nil)
+
+	if strings.ToLower(version) == ProxyProtocolV1 {
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP6"
+		if srcAddr.IP.To4() != nil {
+			proto = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcAddr.IP, dstAddr.IP, srcAddr.Port,
+			dstAddr.Port)
+		return err
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	if !known {
+		header = append(header, proxyV2Version|proxyV2Local, 0, 0, 0)
+		_, err := w.Write(header)
+		return err
+	}
+	family, srcIP, dstIP := byte(proxyV2TCP6), srcAddr.IP.To16(), dstAddr.IP.To16()
+	if srcAddr.IP.To4() != nil {
+		family, srcIP, dstIP = proxyV2TCP4, srcAddr.IP.To4(), dstAddr.IP.To4()
+	}
+	header = append(header, proxyV2Version|proxyV2Proxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+	header = append(append(header, srcIP...), dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcAddr.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstAddr.Port))
+	_, err := w.Write(header)
+	return err
+}
+
+// ParseCIDRs parses a comma separated list of networks, where single
+// addresses stand for themselves. Invalid entries are left out and reported
+// in the error. The list is nil only if there were no entries at all.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	nets := []*net.IPNet{}
+	var invalid []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	if len(invalid) > 0 {
+		return nets, fmt.Errorf("%s is not valid cidr", strings.Join(invalid, ","))
+	}
+	return nets, nil
+}
+
+// Whether addr is in one of the networks, none is if nets is empty.
+func IsTrusted(nets []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// A ProxyListener takes client addresses from the PROXY protocol headers of
+// trusted load balancers, which must send one first thing on every
+// connection. Other clients are served as they are, unless they send a
+// header, which could forge their address. Headers are read on first use of
+// the connection rather than in Accept, so that slow clients don't hold up
+// others.
+type ProxyListener struct {
+	net.Listener
+	sync.RWMutex
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// Trusted as in IsTrusted().
+func NewProxyListener(l net.Listener, trusted []*net.IPNet) *ProxyListener {
+	return &ProxyListener{
+		Listener: l,
+		trusted:  trusted,
+		timeout:  DefaultProxyHeaderTimeout,
+	}
+}
+
+func (l *ProxyListener) SetTrusted(trusted []*net.IPNet) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.trusted = trusted
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.RLock()
+	trusted := IsTrusted(l.trusted, conn.RemoteAddr())
+	l.RUnlock()
+	if !trusted {
+		return &untrustedConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	r        *bufio.Reader
+	timeout  time.Duration
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	c.src, c.dst, c.err = ReadProxyHeader(c.r)
+	c.Conn.SetReadDeadline(time.Time{})
+	if c.err != nil {
+		logger.Errorf("[proxy %s] bad PROXY header: %s", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+type untrustedConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	err  error
+}
+
+// Requests are longer than signatures, so peeking doesn't wait on clients.
+func (c *untrustedConn) checkHeader() {
+	sig, _ := c.r.Peek(len(proxyV2Signature))
+	if bytes.Equal(sig, proxyV2Signature) || bytes.HasPrefix(sig, []byte("PROXY ")) {
+		c.err = errors.New("PROXY header from untrusted client")
+		logger.Errorf("[proxy %s] %s", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+func (c *untrustedConn) Read(p []byte) (int, error) {
+	c.once.Do(c.checkHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+type clientAddrKey struct{}
+
+type connKey struct{}
+
+// The address the client connected to, as in ConnContext().
+func localAddr(ctx context.Context) net.Addr {
+	if conn, ok := ctx.Value(connKey{}).(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	addr, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+// ConnContext is for http.Server, so that the PROXY headers sent to servers
+// have the address clients connected to rather than that of the listener.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// Requests to pools sending PROXY protocol carry the client address to the
+// transport, see NewTransport().
+func withClientAddr(req *http.Request) *http.Request {
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), clientAddrKey{}, addr))
+}
+
+// Dials as dialer does and sends the PROXY header for the client of the
+// request being dialed for, if any.
+func proxyDialer(dialer *net.Dialer, version string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		src, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+		dst := localAddr(ctx)
+		if err := WriteProxyHeader(conn, version, src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,185 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/testutils"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}},
+		{nil, nil},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}},
+	}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for i, test := range tests {
+			var buf bytes.Buffer
+			if err := WriteProxyHeader(&buf, version, test.src, test.dst); err != nil {
+				t.Fatalf("%s %d: failed to write header: %s", version, i, err)
+			}
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			r := bufio.NewReader(&buf)
+			src, dst, err := ReadProxyHeader(r)
+			if err != nil {
+				t.Errorf("%s %d: failed to read header: %s", version, i, err)
+				continue
+			}
+			known := i < 2
+			if known && (fmt.Sprint(src) != fmt.Sprint(test.src) || fmt.Sprint(dst) != fmt.Sprint(test.dst)) {
+				t.Errorf("%s %d: expected %s %s, got %s %s", version, i, test.src, test.dst, src, dst)
+			}
+			if !known && (src != nil || dst != nil) {
+				t.Errorf("%s %d: should send unknown addresses, got %s %s", version, i, src, dst)
+			}
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%s %d: should leave the request, got %q", version, i, rest)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	headers := []string{
+		"GET / HTTP/1.1\r\nHost: test\r\n\r\n",
+		"PROXY TCP4 192.0.2.1 10.0.0.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 10.0.0.1 56324 65536\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x0c",
+	}
+	for i, header := range headers {
+		if _, _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("%d: should not accept %q", i, header)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	if nets, err := ParseCIDRs(""); nets != nil || err != nil {
+		t.Errorf("should list none without entries")
+	}
+	nets, err := ParseCIDRs("10.0.0.0/8, 192.0.2.1,2001:db8::/32,bogus")
+	if err == nil || len(nets) != 3 {
+		t.Errorf("should leave out invalid entries, got %v: %v", nets, err)
+	}
+	trusted := []string{"10.1.2.3:80", "192.0.2.1:80", "[2001:db8::1]:80"}
+	for _, addr := range trusted {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if !IsTrusted(nets, tcpAddr) {
+			t.Errorf("should trust %s", addr)
+		}
+	}
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "192.0.2.2:80")
+	if IsTrusted(nets, tcpAddr) || IsTrusted([]*net.IPNet{}, tcpAddr) || IsTrusted(nil, tcpAddr) {
+		t.Errorf("should not trust %s", tcpAddr)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	nets, _ := ParseCIDRs("127.0.0.1")
+	proxy := NewProxyListener(l, nets)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	go server.Serve(proxy)
+	defer server.Close()
+
+	get := func(header string) (string, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(header + "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	if addr, err := get("PROXY TCP4 192.0.2.1 10.0.0.1 56324 80\r\n"); addr != "192.0.2.1:56324" {
+		t.Errorf("should take client address from header, got %s: %v", addr, err)
+	}
+	if _, err := get(""); err == nil {
+		t.Errorf("should require header from trusted sources")
+	}
+
+	proxy.SetTrusted(nil)
+	if addr, err := get(""); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Errorf("should serve untrusted sources as they are, got %s: %v", addr, err)
+	}
+	if addr, err := get("PROXY TCP4 192.0.2.1 10.0.0.1 56324 80\r\n"); err == nil {
+		t.Errorf("should refuse headers from untrusted sources, got %s", addr)
+	}
+}
+
+func TestHandleProxyProtocol(t *testing.T) {
+	// echoes the PROXY header as a response
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				header, _ := r.ReadString('\n')
+				http.ReadRequest(r)
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nServer-Status: OK\r\nContent-Length: %d\r\n\r\n%s",
+					len(header), header)
+			}()
+		}
+	}()
+
+	config := newTestConfig()
+	config.ProxyProtocol = ProxyProtocolV1
+	pool := NewPool("test", config)
+	defer pool.Shutdown()
+	server := NewServer(l.Addr().String())
+	server.Transport = NewTransport(config)
+	pool.AddServer(l.Addr().String(), server)
+	time.Sleep(50 * time.Millisecond)
+
+	logRecord, rr := testutils.NewTestHAProxyLogRecord("http://" + l.Addr().String())
+	logRecord.Request.RemoteAddr = "192.0.2.1:56324"
+	local, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:80")
+	logRecord.Request = logRecord.Request.WithContext(context.WithValue(logRecord.Request.Context(),
+		http.LocalAddrContextKey, local))
+	pool.Handle(logRecord)
+	body, _ := ioutil.ReadAll(rr.Body)
+	if string(body) != "PROXY TCP4 192.0.2.1 10.0.0.1 56324 80\r\n" {
+		t.Errorf("should send PROXY header, got %q", body)
+	}
+}
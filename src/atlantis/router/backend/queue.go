@@ -0,0 +1,119 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const DefaultMaxQueueTime = 5 * time.Second
+
+// A Queue admits up to max requests at once, holding the rest in order of
+// arrival until a slot frees up or they time out. A max of zero admits all.
+type Queue struct {
+	sync.Mutex
+	max     int
+	active  int
+	waiting list.List
+}
+
+func NewQueue(max int) *Queue {
+	return &Queue{max: max}
+}
+
+func (q *Queue) full() bool {
+	return q.max > 0 && q.active >= q.max
+}
+
+// Waits up to timeout for a slot, returning the number of requests which were
+// queued ahead and whether the slot was taken; if so it must be released.
+func (q *Queue) Acquire(timeout time.Duration) (int, bool) {
+	q.Lock()
+	if !q.full() && q.waiting.Len() == 0 {
+		q.active++
+		q.Unlock()
+		return 0, true
+	}
+	ahead := q.waiting.Len()
+	ch := make(chan bool)
+	elem := q.waiting.PushBack(ch)
+	q.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return ahead, true
+	case <-timer.C:
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	// handed a slot while timing out
+	select {
+	case <-ch:
+		return ahead, true
+	default:
+	}
+	q.waiting.Remove(elem)
+	return ahead, false
+}
+
+// Whether a request would have to wait, all slots being taken.
+func (q *Queue) Busy() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.full() || q.waiting.Len() > 0
+}
+
+func (q *Queue) Release() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.active--
+	q.admit()
+}
+
+// Hands free slots to waiting requests. Must be called holding lock on queue.
+func (q *Queue) admit() {
+	for q.waiting.Len() > 0 && !q.full() {
+		close(q.waiting.Remove(q.waiting.Front()).(chan bool))
+		q.active++
+	}
+}
+
+func (q *Queue) SetMax(max int) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.max = max
+	q.admit()
+}
+
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.waiting.Len()
+}
+
+func (q *Queue) Active() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.active
+}
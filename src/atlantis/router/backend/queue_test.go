@@ -0,0 +1,94 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueUnlimited(t *testing.T) {
+	queue := NewQueue(0)
+	for i := 0; i < 100; i++ {
+		if ahead, ok := queue.Acquire(0); !ok || ahead != 0 {
+			t.Fatalf("should admit everything without max")
+		}
+	}
+	if queue.Active() != 100 {
+		t.Errorf("should count active requests")
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	queue := NewQueue(1)
+	queue.Acquire(0)
+
+	ahead, ok := queue.Acquire(10 * time.Millisecond)
+	if ok || ahead != 0 {
+		t.Errorf("should time out when full")
+	}
+	if queue.Len() != 0 {
+		t.Errorf("should leave queue on timeout")
+	}
+
+	queue.Release()
+	if _, ok := queue.Acquire(0); !ok {
+		t.Errorf("should admit once released")
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	queue := NewQueue(1)
+	queue.Acquire(0)
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			ahead, ok := queue.Acquire(time.Second)
+			if !ok || ahead != i {
+				t.Errorf("should count requests ahead")
+			}
+			order <- i
+			queue.Release()
+		}(i)
+		// let it join the queue before the next one
+		for queue.Len() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	queue.Release()
+	for i := 0; i < 3; i++ {
+		if next := <-order; next != i {
+			t.Errorf("should admit in order of arrival")
+		}
+	}
+}
+
+func TestQueueSetMax(t *testing.T) {
+	queue := NewQueue(1)
+	queue.Acquire(0)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := queue.Acquire(time.Second)
+		done <- ok
+	}()
+	for queue.Len() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	queue.SetMax(2)
+	if !<-done || queue.Active() != 2 {
+		t.Errorf("should admit waiting requests when max grows")
+	}
+}
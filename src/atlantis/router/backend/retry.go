@@ -0,0 +1,159 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Conditions in PoolConfig.RetryOn besides status codes, e.g. "connect,503".
+const (
+	RetryOnConnect = "connect"
+	RetryOnTimeout = "timeout"
+)
+
+const (
+	DefaultRetryOn     = RetryOnConnect
+	DefaultRetryBudget = 20 // percent
+	// Retries the budget can save up while traffic is flowing without them,
+	// and starts out with.
+	RetryBudgetBurst = 10
+)
+
+func IsValidRetryOn(retryOn string) bool {
+	for _, cond := range strings.Split(retryOn, ",") {
+		cond = strings.TrimSpace(cond)
+		if strings.EqualFold(cond, RetryOnConnect) || strings.EqualFold(cond, RetryOnTimeout) {
+			continue
+		}
+		if code, err := strconv.Atoi(cond); err != nil || code < 100 || code > 599 {
+			return false
+		}
+	}
+	return true
+}
+
+func IsIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	default:
+		return false
+	}
+}
+
+// A RetryPolicy decides whether failed attempts at a request are tried again
+// on another server. Retries are limited per request by the attempts, and
+// across the pool by a budget: every request earns a fraction of a retry, and
+// retries are only allowed while there is one to spend. This keeps retries
+// from multiplying the load on a pool which is failing across the board.
+type RetryPolicy struct {
+	sync.Mutex
+	attempts      int
+	connect       bool
+	timeout       bool
+	codes         map[int]bool
+	nonIdempotent bool
+	ratio         float64
+	balance       float64
+}
+
+func NewRetryPolicy(config PoolConfig) *RetryPolicy {
+	retryOn := config.RetryOn
+	if retryOn == "" {
+		retryOn = DefaultRetryOn
+	}
+	budget := config.RetryBudget
+	if budget == 0 {
+		budget = DefaultRetryBudget
+	}
+
+	policy := &RetryPolicy{
+		attempts:      config.MaxAttempts,
+		codes:         map[int]bool{},
+		nonIdempotent: config.RetryNonIdempotent,
+		ratio:         float64(budget) / 100,
+		balance:       RetryBudgetBurst,
+	}
+	for _, cond := range strings.Split(retryOn, ",") {
+		cond = strings.TrimSpace(cond)
+		switch {
+		case strings.EqualFold(cond, RetryOnConnect):
+			policy.connect = true
+		case strings.EqualFold(cond, RetryOnTimeout):
+			policy.timeout = true
+		default:
+			if code, err := strconv.Atoi(cond); err == nil {
+				policy.codes[code] = true
+			}
+		}
+	}
+
+	return policy
+}
+
+// Called once per request to earn its share of the budget.
+func (r *RetryPolicy) Deposit() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.balance += r.ratio
+	if r.balance > RetryBudgetBurst {
+		r.balance = RetryBudgetBurst
+	}
+}
+
+func (r *RetryPolicy) withdraw() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.balance < 1 {
+		return false
+	}
+	r.balance--
+	return true
+}
+
+// Whether the request may be sent again at all, regardless of outcome. Bodies
+// have been consumed by the first attempt, so only requests without one are
+// retried.
+func (r *RetryPolicy) Retryable(req *http.Request, attempt int) bool {
+	if attempt+1 >= r.attempts {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		return false
+	}
+	return r.nonIdempotent || IsIdempotent(req.Method)
+}
+
+// Whether the outcome of an attempt calls for a retry, spending the budget if
+// it does.
+func (r *RetryPolicy) Retry(resErr ResponseError) bool {
+	switch {
+	case resErr.Error != nil && IsTimeout(resErr.Error):
+		if !r.timeout {
+			return false
+		}
+	case resErr.Error != nil:
+		if !r.connect {
+			return false
+		}
+	case !r.codes[resErr.Response.StatusCode]:
+		return false
+	}
+
+	return r.withdraw()
+}
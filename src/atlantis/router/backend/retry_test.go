@@ -0,0 +1,103 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIsValidRetryOn(t *testing.T) {
+	if !IsValidRetryOn("connect,timeout, 502,503") {
+		t.Errorf("should accept conditions and status codes")
+	}
+	if IsValidRetryOn("connect,sometimes") || IsValidRetryOn("999") {
+		t.Errorf("should reject unknown conditions and status codes")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	policy := NewRetryPolicy(PoolConfig{MaxAttempts: 2})
+
+	get, _ := http.NewRequest("GET", "http://www.ooyala.com/", nil)
+	if !policy.Retryable(get, 0) {
+		t.Errorf("should retry idempotent requests")
+	}
+	if policy.Retryable(get, 1) {
+		t.Errorf("should stop after max attempts")
+	}
+
+	post, _ := http.NewRequest("POST", "http://www.ooyala.com/", nil)
+	if policy.Retryable(post, 0) {
+		t.Errorf("should not retry non-idempotent requests by default")
+	}
+
+	put, _ := http.NewRequest("PUT", "http://www.ooyala.com/", strings.NewReader("body"))
+	if policy.Retryable(put, 0) {
+		t.Errorf("should not retry requests with a body")
+	}
+
+	policy = NewRetryPolicy(PoolConfig{MaxAttempts: 2, RetryNonIdempotent: true})
+	if !policy.Retryable(post, 0) {
+		t.Errorf("should retry non-idempotent requests when configured")
+	}
+
+	policy = NewRetryPolicy(PoolConfig{})
+	if policy.Retryable(get, 0) {
+		t.Errorf("should not retry by default")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := NewRetryPolicy(PoolConfig{MaxAttempts: 2})
+
+	if !policy.Retry(ResponseError{nil, errors.New("connection refused")}) {
+		t.Errorf("should retry connection errors by default")
+	}
+	if policy.Retry(ResponseError{nil, errors.New("net/http: request canceled")}) {
+		t.Errorf("should not retry timeouts by default")
+	}
+	if policy.Retry(ResponseError{&http.Response{StatusCode: 503}, nil}) {
+		t.Errorf("should not retry status codes by default")
+	}
+
+	policy = NewRetryPolicy(PoolConfig{MaxAttempts: 2, RetryOn: "timeout,503"})
+	if policy.Retry(ResponseError{nil, errors.New("connection refused")}) {
+		t.Errorf("should only retry configured conditions")
+	}
+	if !policy.Retry(ResponseError{nil, errors.New("net/http: request canceled")}) ||
+		!policy.Retry(ResponseError{&http.Response{StatusCode: 503}, nil}) {
+		t.Errorf("should retry configured conditions")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	policy := NewRetryPolicy(PoolConfig{MaxAttempts: 2, RetryBudget: 50})
+	resErr := ResponseError{nil, errors.New("connection refused")}
+
+	for i := 0; i < RetryBudgetBurst; i++ {
+		if !policy.Retry(resErr) {
+			t.Fatalf("should start out with a burst of retries")
+		}
+	}
+	if policy.Retry(resErr) {
+		t.Errorf("should stop retrying when budget is spent")
+	}
+
+	policy.Deposit()
+	policy.Deposit()
+	if !policy.Retry(resErr) || policy.Retry(resErr) {
+		t.Errorf("should earn retries in proportion to requests")
+	}
+}
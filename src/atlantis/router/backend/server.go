@@ -13,28 +13,60 @@ package backend
 
 import (
 	"atlantis/router/logger"
+	"atlantis/router/tracing"
+	"context"
 	"errors"
 	"fmt"
+	"mime"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Host weights are relative to DefaultWeight, so a server with weight 200
+// should get twice the traffic of a standard one.
+const DefaultWeight = 100
+
+type ServerConfig struct {
+	Weight uint32
+	Zone   string
+	Tags   map[string]string
+	// Requests in flight before queueing, the pool's ServerMaxConn if zero
+	MaxConn int
+}
+
 type Server struct {
 	Address   string
+	Config    ServerConfig
 	Status    ServerStatus
 	Metrics   ServerMetrics
+	Outlier   ServerOutlier
+	Breaker   *CircuitBreaker
+	Queue     *Queue
 	Transport *http.Transport
+	// guards Transport, which pools swap on reconfiguration
+	transportLock sync.RWMutex
+	// closed when draining times out, cancelling requests still in flight
+	cancel chan bool
+	// serializes health checks, as the jittered ones and those of servers
+	// just updated may overlap, and status updates count consecutive results
+	checkLock sync.Mutex
 }
 
 func NewServer(address string) *Server {
 	return &Server{
 		Address: address,
-		Status:  NewServerStatus(),
-		Metrics: NewServerMetrics(),
-		Transport: &http.Transport{
-			MaxIdleConnsPerHost: 32,
+		Config: ServerConfig{
+			Weight: DefaultWeight,
 		},
+		Status:    NewServerStatus(),
+		Metrics:   NewServerMetrics(),
+		Queue:     NewQueue(0),
+		cancel:    make(chan bool),
+		Transport: NewTransport(PoolConfig{}),
 	}
 }
 
@@ -44,6 +76,26 @@ type ResponseError struct {
 }
 
 func (s *Server) RoundTrip(req *http.Request, ch chan ResponseError) {
+	s.roundTrip(s.transport(), req, ch)
+}
+
+// Requests are cancelled through their context, as Transport.CancelRequest
+// does nothing for HTTP/2. The cause they are cancelled with is the error of
+// the roundtrip.
+func withCancel(req *http.Request) (*http.Request, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	return req.WithContext(ctx), cancel
+}
+
+// Causes of cancelled attempts, timeouts to IsTimeout like those of the
+// transport.
+var (
+	errResponseTimeout = errors.New("net/http: request canceled awaiting response headers")
+	errDrainTimeout    = errors.New("net/http: request canceled draining server")
+)
+
+// The transport is passed in as the server's may be replaced in the meantime.
+func (s *Server) roundTrip(transport *http.Transport, req *http.Request, ch chan ResponseError) {
 	defer func() {
 		if r := recover(); r != nil {
 			err := fmt.Sprintf("%s", r)
@@ -52,9 +104,15 @@ func (s *Server) RoundTrip(req *http.Request, ch chan ResponseError) {
 	}()
 
 	req.URL.Scheme = "http"
+	if IsTLS(transport) {
+		req.URL.Scheme = "https"
+	}
 	req.URL.Host = s.Address
 
-	resp, err := s.Transport.RoundTrip(req)
+	resp, err := transport.RoundTrip(req)
+	if cause := context.Cause(req.Context()); err != nil && cause != nil {
+		err = cause
+	}
 	if err == nil {
 		ch <- ResponseError{resp, nil}
 	} else {
@@ -63,85 +121,293 @@ func (s *Server) RoundTrip(req *http.Request, ch chan ResponseError) {
 }
 
 func (s *Server) Handle(logRecord *logger.HAProxyLogRecord, tout time.Duration) {
+	s.TryHandle(logRecord, tout, 0, 0, nil)
+}
+
+// TryHandle is Handle with a say in failed attempts: when retry returns true
+// for the response or error, nothing is written to the client and TryHandle
+// returns true, leaving the caller to try the request elsewhere. Queued is the
+// number of requests which were waiting for the server ahead of this one. The
+// timeout is for the response headers; streamed bodies take as long as they
+// take, unless draining the server times out. Flush is the pool's, see
+// FlushInterval().
+func (s *Server) TryHandle(logRecord *logger.HAProxyLogRecord, tout, flush time.Duration, queued uint64,
+	retry func(ResponseError) bool) bool {
 	sTime := time.Now()
 	s.Metrics.RequestStart()
 	defer s.Metrics.RequestDone()
 
-	// X-Forwarded-For; we are a proxy.
-	ip := strings.Split(logRecord.Request.RemoteAddr, ":")[0]
-	logRecord.Request.Header.Add("X-Forwarded-For", ip)
-	logRecord.ServerUpdateRecord(s.Address, s.Metrics.RequestsServiced, s.Metrics.Cost(), sTime)
+	// Only once, retries reuse the request.
+	if logRecord.Retries() == 0 {
+		sanitizeRequest(logRecord.Request)
+		forwarded(logRecord.Request)
+	}
+	logRecord.ServerUpdateRecord(s.Address, queued, s.Metrics.Cost(), sTime)
+	span := s.startSpan(logRecord, "upstream")
+	defer span.Finish()
 	resErrCh := make(chan ResponseError)
+	req, cancelAttempt := withCancel(logRecord.Request)
+	defer cancelAttempt(nil)
 	tstart := time.Now()
-	go s.RoundTrip(logRecord.Request, resErrCh)
+	go s.roundTrip(s.transport(), req, resErrCh)
 	tend := time.Now()
 	logRecord.UpdateTr(tstart, tend)
+	cancel := s.cancel
 	for {
 		select {
 		case resErr := <-resErrCh:
 			if resErr.Response != nil {
 				defer resErr.Response.Body.Close()
 			}
+			latency := time.Since(tstart)
+			span.SetResult(resErr.Response, resErr.Error)
+			// the gRPC status of responses with a body is only in the trailers
+			inTrailers := resErr.Error == nil && IsGRPC(resErr.Response.Header) &&
+				resErr.Response.Header.Get(GRPCStatusHeader) == ""
+			if !inTrailers {
+				s.observe(resErr, latency)
+			}
+			if retry != nil && retry(resErr) {
+				if resErr.Error != nil {
+					logRecord.Errorf("[server %s] failed attempting the roundtrip, retrying: %s\n", s.Address, resErr.Error)
+				} else {
+					logRecord.Errorf("[server %s] responded %d, retrying\n", s.Address, resErr.Response.StatusCode)
+				}
+				return true
+			}
 			if resErr.Error == nil {
+				logRecord.SetServerProto(resErr.Response.Proto)
+				removeHopHeaders(resErr.Response.Header)
 				logRecord.CopyHeaders(resErr.Response.Header)
 				logRecord.WriteHeader(resErr.Response.StatusCode)
 
-				err := logRecord.Copy(resErr.Response.Body)
+				var err error
+				if interval := FlushInterval(resErr.Response, flush); interval != 0 {
+					err = s.stream(logRecord, resErr.Response, interval, cancel)
+				} else {
+					err = logRecord.Copy(resErr.Response.Body)
+				}
+				logRecord.CopyTrailers(resErr.Response.Trailer)
+				if inTrailers {
+					s.observe(resErr, latency)
+				}
 				if err != nil {
-					logger.Errorf("[server %s] failed attempting to copy response body: %s\n", s.Address, err)
+					logRecord.Errorf("[server %s] failed attempting to copy response body: %s\n", s.Address, err)
 				} else {
 					logRecord.Log()
 				}
 			} else {
-				logger.Errorf("[server %s] failed attempting the roundtrip: %s\n", s.Address, resErr.Error)
-				msg := logger.BadGatewayMsg
-				status := http.StatusBadGateway
-				if strings.Contains(resErr.Error.Error(), "request canceled") {
-					msg = logger.GatewayTimeoutMsg
-					status = http.StatusGatewayTimeout
-				}
-				logRecord.Error(msg, status)
-				logRecord.Terminate("Server: " + msg)
+				s.fail(logRecord, resErr.Error)
 			}
-			return
+			return false
 		case <-time.After(tout):
-			// close socket, RoundTrip will return error (or data if the transaction completed before close)
-			s.Transport.CancelRequest(logRecord.Request)
+			// RoundTrip will return error (or data if the transaction completed before cancelling)
+			cancelAttempt(errResponseTimeout)
+		case <-cancel:
+			cancelAttempt(errDrainTimeout)
+			cancel = nil
 		}
 	}
 }
-func (s *Server) CheckStatus(tout time.Duration) {
-	r, _ := http.NewRequest("GET", "http://"+s.Address+"/healthz", nil)
 
-	resErrCh := make(chan ResponseError)
-	go s.RoundTrip(r, resErrCh)
+// Starts the span of an attempt at the request, passing it on to the server
+// as the parent of its own.
+func (s *Server) startSpan(logRecord *logger.HAProxyLogRecord, name string) *tracing.Span {
+	span := tracing.FromContext(logRecord.Request.Context()).Child(name, tracing.SpanKindClient)
+	span.SetAttribute("server.address", s.Address)
+	span.Inject(logRecord.Request.Header)
+	return span
+}
 
-	for {
+// How often responses are flushed to the client: after every write if
+// negative, at most this long after being written if positive, or never, i.e.
+// only once buffers fill. Server-sent events, gRPC and other responses of
+// unknown length are flushed after every write, unless configured otherwise.
+func FlushInterval(res *http.Response, configured time.Duration) time.Duration {
+	if IsGRPC(res.Header) {
+		return -1
+	}
+	if configured != 0 {
+		return configured
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || res.ContentLength == -1 {
+		return -1
+	}
+	return 0
+}
+
+// Server-sent events and gRPC streams may stay open for long, unlike other
+// responses streamed for want of a length.
+func isLongLived(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return IsGRPC(res.Header) || mediaType == "text/event-stream"
+}
+
+// Long lived streams may outlast the port write timeout, so it is lifted for
+// them, but they are cut off when draining the server times out.
+func (s *Server) stream(logRecord *logger.HAProxyLogRecord, res *http.Response, interval time.Duration,
+	cancel chan bool) error {
+	if isLongLived(res) {
+		http.NewResponseController(logRecord.ResponseWriter).SetWriteDeadline(time.Time{})
+	}
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
 		select {
-		case resErr := <-resErrCh:
-			if resErr.Response != nil {
-				defer resErr.Response.Body.Close()
-			}
-			if resErr.Error == nil {
+		case <-cancel:
+			res.Body.Close()
+		case <-done:
+		}
+	}()
 
-				//if status has changed then log
-				if s.Status.ParseAndSet(resErr.Response) {
-					logger.Printf("[server %s] status code changed to %d\n", s.Address, resErr.Response.StatusCode)
-				}
-			} else {
-				//if status has changed then log
-				if s.Status.Set(StatusCritical) {
-					logger.Errorf("[server %s] status set to critical! : %s\n", s.Address, resErr.Error)
-				}
+	return logRecord.Stream(res.Body, interval)
+}
+
+// Answers the client when the roundtrip failed.
+func (s *Server) fail(logRecord *logger.HAProxyLogRecord, err error) {
+	logRecord.Errorf("[server %s] failed attempting the roundtrip: %s\n", s.Address, err)
+	msg := logger.BadGatewayMsg
+	status := http.StatusBadGateway
+	if IsTimeout(err) {
+		msg = logger.GatewayTimeoutMsg
+		status = http.StatusGatewayTimeout
+	}
+	logRecord.Error(msg, status)
+	logRecord.Terminate("Server: " + msg)
+}
+
+// Feeds the outcome of a request to outlier detection, the circuit breaker
+// and metrics.
+func (s *Server) observe(resErr ResponseError, latency time.Duration) {
+	s.Outlier.Observe(resErr, latency)
+	if resErr.Error != nil {
+		s.Breaker.Record(false)
+		return
+	}
+
+	res := resErr.Response
+	s.Breaker.Record(ResponseStatus(res.StatusCode, res.Header, res.Trailer) < 500)
+	if code, ok := GRPCStatus(res.Header, res.Trailer); ok && code != GRPCOK {
+		s.Metrics.GRPCError()
+	}
+}
+
+const (
+	DefaultDrainTimeout = 30 * time.Second
+	drainPollInterval   = 100 * time.Millisecond
+)
+
+// Drain waits up to timeout for requests in flight to complete, cancelling
+// those which don't, and returns whether all did. Servers must no longer be
+// in a pool's list when drained.
+func (s *Server) Drain(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadUint32(&s.Metrics.RequestsInFlight) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			close(s.cancel)
+			return false
+		}
+	}
+	return true
+}
+
+// Requests cancelled on timeout, or not answered within the response header
+// timeout, fail with these errors from the transport.
+func IsTimeout(err error) bool {
+	return strings.Contains(err.Error(), "request canceled") ||
+		strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+func (s *Server) CheckStatus(tout time.Duration) {
+	s.CheckHealth(NewHealthCheck(PoolConfig{}), tout)
+}
+
+// CheckHealth is CheckStatus as configured for the pool.
+func (s *Server) CheckHealth(check *HealthCheck, tout time.Duration) {
+	s.checkLock.Lock()
+	defer s.checkLock.Unlock()
+
+	if check.tcp {
+		conn, err := net.DialTimeout("tcp", s.Address, tout)
+		if err != nil {
+			if s.Status.Update(StatusCritical, check.rise, check.fall) {
+				logger.Errorf("[server %s] status set to critical! : %s\n", s.Address, err)
 			}
 			return
-		case <-time.After(tout):
-			// close socket, RoundTrip will return error (or data if the transaction completed before close)
-			s.Transport.CancelRequest(r)
+		}
+		conn.Close()
+		if s.Status.Update(StatusOk, check.rise, check.fall) {
+			logger.Printf("[server %s] status changed to %s\n", s.Address, StatusOk)
+		}
+		return
+	}
+
+	r, err := check.Request(s.Address)
+	if err != nil {
+		logger.Errorf("[server %s] bad health check: %s\n", s.Address, err)
+		return
+	}
+	// the body may be read too, the whole check takes at most the timeout
+	ctx, cancel := context.WithTimeout(r.Context(), tout)
+	defer cancel()
+
+	resErrCh := make(chan ResponseError, 1)
+	go s.roundTrip(s.transport(), r.WithContext(ctx), resErrCh)
+
+	resErr := <-resErrCh
+	if resErr.Response != nil {
+		defer resErr.Response.Body.Close()
+	}
+	if resErr.Error == nil {
+		status := check.Status(resErr.Response)
+
+		//if status has changed then log
+		if s.Status.Update(status, check.rise, check.fall) {
+			logger.Printf("[server %s] status code changed to %d\n", s.Address, resErr.Response.StatusCode)
+		}
+	} else {
+		//if status has changed then log
+		if s.Status.Update(StatusCritical, check.rise, check.fall) {
+			logger.Errorf("[server %s] status set to critical! : %s\n", s.Address, resErr.Error)
 		}
 	}
 }
 
+// Requests in flight are scaled by the host weight, so that a server with
+// twice the weight is as cheap with twice the requests.
 func (s *Server) Cost(accept string) uint32 {
-	return s.Status.Cost(accept) + s.Metrics.Cost()
+	return s.Status.Cost(accept) + s.Metrics.Cost()*DefaultWeight/s.weight()
+}
+
+const MaxWeight = 256
+
+// Weight turns Cost() without the requests in flight into a relative weight
+// for the weighted strategies: MaxWeight for a warmed up server with accepted
+// status and default host weight, shrinking for degraded, critical and
+// slow-starting servers.
+func (s *Server) Weight(accept string) int {
+	cost := s.Status.Cost(accept)
+
+	weight := MaxWeight >> (cost >> 28)
+	weight = weight * int(Kstartup-cost&0x0fffffff) / Kstartup
+	weight = weight * int(s.weight()) / DefaultWeight
+	if weight < 1 {
+		weight = 1
+	}
+
+	return weight
+}
+
+func (s *Server) weight() uint32 {
+	if s.Config.Weight == 0 {
+		return DefaultWeight
+	}
+	return s.Config.Weight
 }
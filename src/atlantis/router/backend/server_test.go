@@ -12,9 +12,14 @@
 package backend
 
 import (
+	"atlantis/router/logger"
 	"atlantis/router/testutils"
+	"atlantis/router/tracing"
+	"bufio"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 )
@@ -112,6 +117,89 @@ func TestHandleXForwardedFor(t *testing.T) {
 	}
 }
 
+func TestHandleRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Id", r.Header.Get(logger.RequestIDHeader))
+		w.Header().Set(logger.RequestIDHeader, "Pluto")
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.Listener.Addr().String())
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL)
+	id := logger.NewRequestID()
+	logRecord.Request.Header.Set(logger.RequestIDHeader, id)
+	logRecord.SetRequestID(id)
+	server.Handle(logRecord, 100*time.Millisecond)
+
+	if rr.Header().Get("X-Seen-Id") != id {
+		t.Errorf("should forward request id")
+	}
+	if ids := rr.Header()[logger.RequestIDHeader]; len(ids) != 1 || ids[0] != id {
+		t.Errorf("should echo request id, got %v", ids)
+	}
+}
+
+func TestTunnelRequestID(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+	pool := newTestPool(t, newTestConfig(), backend.Listener.Addr().String())
+	frontend := newFrontend(pool, nil)
+	defer frontend.Close()
+
+	id := logger.NewRequestID()
+	conn, _, res := dialUpgrade(t, frontend.URL, "echo", logger.RequestIDHeader+": "+id)
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("should switch protocols, got %d", res.StatusCode)
+	}
+	if ids := res.Header[logger.RequestIDHeader]; len(ids) != 1 || ids[0] != id {
+		t.Errorf("should echo request id on upgrades, got %v", ids)
+	}
+}
+
+type spanRecorder struct {
+	spans []*tracing.Span
+}
+
+func (r *spanRecorder) Export(spans []*tracing.Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestHandleTrace(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Traceparent", r.Header.Get(tracing.TraceparentHeader))
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+
+	recorder := &spanRecorder{}
+	tracer := tracing.NewTracer(recorder)
+	server := NewServer(backend.Listener.Addr().String())
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL)
+	logRecord.Request.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := tracer.StartRequest(logRecord.Request, "GET", 0)
+	logRecord.Request = logRecord.Request.WithContext(tracing.NewContext(logRecord.Request.Context(), span))
+	server.Handle(logRecord, 100*time.Millisecond)
+	span.Finish()
+	tracer.Shutdown()
+
+	if len(recorder.spans) != 2 {
+		t.Fatalf("should export request and upstream spans, got %d", len(recorder.spans))
+	}
+	upstream := recorder.spans[0]
+	if upstream.ParentID != span.SpanID || upstream.Kind != tracing.SpanKindClient {
+		t.Errorf("should export upstream span as child of request span")
+	}
+	if upstream.Attributes["http.response.status_code"] != http.StatusTeapot {
+		t.Errorf("should record response status, got %v", upstream.Attributes)
+	}
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + upstream.SpanID.String() + "-01"
+	if seen := rr.Header().Get("X-Seen-Traceparent"); seen != expected {
+		t.Errorf("should send upstream span to server, got %s", seen)
+	}
+}
+
 func TestHandleResponseHeaders(t *testing.T) {
 	backend := testutils.NewBackend(0, false)
 	defer backend.Shutdown()
@@ -145,6 +233,145 @@ func TestHandleTimeout(t *testing.T) {
 	}
 }
 
+func TestHandleTimeoutH2C(t *testing.T) {
+	backend := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(3 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.Listener.Addr().String())
+	server.Transport = NewTransport(PoolConfig{HTTP2: true})
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL)
+	start := time.Now()
+	server.Handle(logRecord, 200*time.Millisecond)
+
+	if rr.Code != http.StatusGatewayTimeout || logRecord.GetResponseStatusCode() != http.StatusGatewayTimeout {
+		t.Errorf("should time out HTTP/2 requests, got %d", rr.Code)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("should not wait for the server to answer")
+	}
+}
+
+func TestCheckStatusTimeoutH2C(t *testing.T) {
+	backend := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.Listener.Addr().String())
+	server.Transport = NewTransport(PoolConfig{HTTP2: true})
+	done := make(chan bool)
+	go func() {
+		server.CheckStatus(10 * time.Millisecond)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("should time out HTTP/2 health checks")
+	}
+	if server.Status.Current != StatusCritical {
+		t.Errorf("should set status to critical on timeout")
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	tests := []struct {
+		configured    time.Duration
+		contentType   string
+		contentLength int64
+		expected      time.Duration
+	}{
+		{0, "text/plain", 10, 0},
+		{0, "text/event-stream; charset=utf-8", 10, -1},
+		{0, "text/plain", -1, -1},
+		{0, "application/grpc", 10, -1},
+		{time.Second, "text/plain", 10, time.Second},
+		{time.Second, "text/event-stream", -1, time.Second},
+		{time.Second, "application/grpc", -1, -1},
+	}
+	for i, test := range tests {
+		res := &http.Response{Header: http.Header{"Content-Type": {test.contentType}},
+			ContentLength: test.contentLength}
+		if interval := FlushInterval(res, test.configured); interval != test.expected {
+			t.Errorf("%d: expected %s, got %s", i, test.expected, interval)
+		}
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	next := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			w.Write([]byte("data: Mickey Mouse!\n\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer backend.Close()
+	defer close(next)
+
+	server := NewServer(backend.Listener.Addr().String())
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRecord := logger.NewHAProxyLogRecord(w, r, "test", 0, time.Now())
+		server.Handle(&logRecord, 30*time.Millisecond)
+	}))
+	frontend.Config.WriteTimeout = 50 * time.Millisecond
+	frontend.Start()
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatalf("failed to get stream: %s", err)
+	}
+	defer res.Body.Close()
+	br := bufio.NewReader(res.Body)
+	for i := 0; i < 2; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil || line != "data: Mickey Mouse!\n" {
+			t.Fatalf("should flush event %d, got %q: %v", i, line, err)
+		}
+		br.ReadString('\n')
+		// past both the request and the port write timeout
+		time.Sleep(100 * time.Millisecond)
+		next <- true
+	}
+}
+
+func TestHandleStreamWriteTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 2; i++ {
+			w.Write([]byte("Mickey Mouse!\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	server := NewServer(backend.Listener.Addr().String())
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRecord := logger.NewHAProxyLogRecord(w, r, "test", 0, time.Now())
+		server.Handle(&logRecord, 30*time.Millisecond)
+	}))
+	frontend.Config.WriteTimeout = 50 * time.Millisecond
+	frontend.Start()
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatalf("failed to get response: %s", err)
+	}
+	defer res.Body.Close()
+	if body, err := ioutil.ReadAll(res.Body); err == nil {
+		t.Errorf("should keep port write timeout for chunked responses, got %q", body)
+	}
+}
+
 func TestCheckStatus(t *testing.T) {
 	backend := testutils.NewBackend(0, false)
 	defer backend.Shutdown()
@@ -169,6 +396,31 @@ func TestCheckStatus(t *testing.T) {
 	}
 }
 
+func TestCheckHealthOverlap(t *testing.T) {
+	backend := testutils.NewBackend(0, false)
+	server := NewServer(backend.Address())
+	backend.Shutdown()
+	server.Status.Set(StatusOk)
+
+	check := NewHealthCheck(PoolConfig{HealthzFall: 4})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			server.CheckHealth(check, 100*time.Millisecond)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if server.Status.Current != StatusOk {
+		t.Errorf("should not go critical before fall results")
+	}
+	server.CheckHealth(check, 100*time.Millisecond)
+	if server.Status.Current != StatusCritical {
+		t.Errorf("should count overlapping checks, got %s", server.Status.Current)
+	}
+}
+
 func TestCheckStatusTimeout(t *testing.T) {
 	backend := testutils.NewBackend(100, false)
 	defer backend.Shutdown()
@@ -179,3 +431,58 @@ func TestCheckStatusTimeout(t *testing.T) {
 		t.Errorf("should set status to critical on timeout")
 	}
 }
+
+func TestDrainTimeout(t *testing.T) {
+	backend := testutils.NewBackend(500, false)
+	defer backend.Shutdown()
+
+	server := NewServer(backend.Address())
+	if !server.Drain(time.Second) {
+		t.Errorf("should drain idle server right away")
+	}
+
+	server = NewServer(backend.Address())
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+	done := make(chan bool)
+	go func() {
+		server.Handle(logRecord, 2*time.Second)
+		done <- true
+	}()
+	for server.Metrics.Cost() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if server.Drain(50 * time.Millisecond) {
+		t.Errorf("should time out draining")
+	}
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatalf("should cancel requests in flight")
+	}
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("should report cancelled requests")
+	}
+}
+
+func TestCostWeight(t *testing.T) {
+	server0 := NewServer("127.0.0.1:80")
+	server0.Status.Set(StatusOk)
+	server0.Status.Changed = time.Unix(0, 0)
+
+	server1 := NewServer("127.0.0.1:81")
+	server1.Status = server0.Status
+	server1.Config.Weight = 2 * DefaultWeight
+
+	server0.Metrics.RequestStart()
+	server1.Metrics.RequestStart()
+	server1.Metrics.RequestStart()
+
+	if server0.Cost(StatusOk) != server1.Cost(StatusOk) {
+		t.Errorf("should scale requests in flight by weight")
+	}
+
+	if server1.Weight(StatusOk) != 2*server0.Weight(StatusOk) {
+		t.Errorf("should scale weight by host weight")
+	}
+}
@@ -29,6 +29,11 @@ type ServerStatus struct {
 	Current string
 	Checked time.Time
 	Changed time.Time
+	// ramp of SlowStartFactor(), set from the pool config
+	SlowStart      time.Duration
+	SlowStartCurve string
+	// consecutive check results on the other side of CRITICAL from Current
+	streak int
 }
 
 func NewServerStatus() ServerStatus {
@@ -51,6 +56,35 @@ func (s *ServerStatus) Set(status string) bool {
 
 }
 
+// Update sets the status from a health check result, but only once fall
+// consecutive results are CRITICAL when the server was up, or rise consecutive
+// results are not when it was CRITICAL. Servers of unknown status and servers
+// going into maintenance change right away.
+func (s *ServerStatus) Update(status string, rise, fall int) bool {
+	critical := status == StatusCritical
+	wasCritical := s.Current == StatusCritical
+
+	need := 1
+	switch {
+	case critical && !wasCritical && s.Current != StatusUnknown:
+		need = fall
+	case !critical && wasCritical && status != StatusMaintenance:
+		need = rise
+	}
+	if critical == wasCritical || need <= 1 {
+		s.streak = 0
+		return s.Set(status)
+	}
+
+	s.streak++
+	if s.streak < need {
+		s.Checked = time.Now()
+		return false
+	}
+	s.streak = 0
+	return s.Set(status)
+}
+
 func StatusWeight(s string) uint32 {
 	switch s {
 	case StatusOk:
@@ -91,21 +125,58 @@ const (
 	Kstartup = 4096 // Maximum slow start cost
 )
 
+// Shapes of the slow start ramp.
+const (
+	SlowStartHyperbolic = "hyperbolic"
+	SlowStartLinear     = "linear"
+	SlowStartNone       = "none"
+)
+
+func IsValidSlowStartCurve(curve string) bool {
+	switch strings.ToLower(curve) {
+	case SlowStartHyperbolic, SlowStartLinear, SlowStartNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Falls from Kstartup when the status changes to 0 after the slow start time,
+// Tstartup seconds unless configured. Hyperbolic by default, so that servers
+// take little traffic for the first few seconds.
 func (s *ServerStatus) SlowStartFactor() uint32 {
 	if !IsValidStatus(s.Current) {
 		return 0
 	}
 
+	t := int64(Tstartup)
+	if s.SlowStart > 0 {
+		t = int64((s.SlowStart + time.Second - 1) / time.Second)
+	}
+
 	d := time.Now().Unix() - s.Changed.Unix()
 	f := uint32(0)
-	if d > Tstartup {
+	switch strings.ToLower(s.SlowStartCurve) {
+	case SlowStartNone:
 		f = 0
-	} else if d > 0 {
-		k := float64(Kstartup)
-		f = uint32(k/float64(d) - k/float64(Tstartup))
-	} else {
-		// d == 0
-		f = Kstartup
+	case SlowStartLinear:
+		if d >= t {
+			f = 0
+		} else if d > 0 {
+			f = uint32(Kstartup * (t - d) / t)
+		} else {
+			f = Kstartup
+		}
+	default:
+		if d > t {
+			f = 0
+		} else if d > 0 {
+			k := float64(Kstartup)
+			f = uint32(k/float64(d) - k/float64(t))
+		} else {
+			// d == 0
+			f = Kstartup
+		}
 	}
 
 	return f
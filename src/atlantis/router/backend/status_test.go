@@ -79,6 +79,45 @@ func TestIsValidStatus(t *testing.T) {
 	}
 }
 
+func TestUpdateRiseFall(t *testing.T) {
+	status := NewServerStatus()
+
+	if !status.Update(StatusOk, 2, 3) {
+		t.Errorf("should change unknown status right away")
+	}
+
+	status.Update(StatusCritical, 2, 3)
+	status.Update(StatusCritical, 2, 3)
+	if status.Current != StatusOk {
+		t.Errorf("should stay up until fall results are critical")
+	}
+	status.Update(StatusDegraded, 2, 3)
+	status.Update(StatusCritical, 2, 3)
+	status.Update(StatusCritical, 2, 3)
+	if status.Current != StatusDegraded {
+		t.Errorf("should only count consecutive critical results")
+	}
+	status.Update(StatusCritical, 2, 3)
+	if status.Current != StatusCritical {
+		t.Errorf("should go critical after fall results")
+	}
+
+	status.Update(StatusOk, 2, 3)
+	if status.Current != StatusCritical {
+		t.Errorf("should stay critical until rise results are up")
+	}
+	status.Update(StatusDegraded, 2, 3)
+	if status.Current != StatusDegraded {
+		t.Errorf("should come up after rise results")
+	}
+
+	status.Update(StatusCritical, 2, 1)
+	status.Update(StatusMaintenance, 2, 1)
+	if status.Current != StatusMaintenance {
+		t.Errorf("should go into maintenance right away")
+	}
+}
+
 func TestParseAndSet(t *testing.T) {
 	status := NewServerStatus()
 
@@ -149,6 +188,34 @@ func TestSlowStartFactor(t *testing.T) {
 	}
 }
 
+func TestSlowStartCurve(t *testing.T) {
+	status := NewServerStatus()
+	status.Set(StatusOk)
+	status.SlowStart = 10 * time.Second
+
+	status.Changed = time.Now().Add(-5 * time.Second)
+	hyperbolic := status.SlowStartFactor()
+	if hyperbolic != 409 { // Kstartup/5 - Kstartup/10
+		t.Errorf("should scale hyperbolic curve to slow start time")
+	}
+
+	status.SlowStartCurve = SlowStartLinear
+	if status.SlowStartFactor() != Kstartup/2 {
+		t.Errorf("should fall linearly")
+	}
+
+	status.Changed = time.Now().Add(-10 * time.Second)
+	if status.SlowStartFactor() != 0 {
+		t.Errorf("should be zero after slow start time")
+	}
+
+	status.Changed = time.Now()
+	status.SlowStartCurve = SlowStartNone
+	if status.SlowStartFactor() != 0 {
+		t.Errorf("should be zero when disabled")
+	}
+}
+
 func TestSlowStartShape(t *testing.T) {
 	if !testing.Verbose() {
 		t.Skipf("skipping shape test, use verbose to run")
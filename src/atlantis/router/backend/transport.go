@@ -0,0 +1,195 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/logger"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// NewTransport returns a transport for a server of a pool, tuned as in config.
+// Zero durations leave the respective timeout off, except that idle
+// connections are closed after DefaultIdleConnTimeout, so that none linger on
+// transports replaced while requests were in flight. Servers speak HTTPS over
+// transports with TLS enabled. With HTTP2, HTTP/2 is negotiated over TLS and
+// spoken with prior knowledge (h2c) otherwise. Connections sending PROXY
+// protocol are for one client and so not kept alive.
+func NewTransport(config PoolConfig) *http.Transport {
+	maxIdle := config.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle = DefaultMaxIdleConnsPerHost
+	}
+	idle := config.IdleConnTimeout
+	if idle == 0 {
+		idle = DefaultIdleConnTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.ConnectTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+	transport := &http.Transport{
+		Dial:                  dialer.Dial,
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       idle,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		DisableKeepAlives:     config.DisableKeepAlives,
+	}
+
+	if config.TLS {
+		tlsConfig, err := NewTLSConfig(config)
+		if err != nil {
+			// rather fail verification than fall back to plain HTTP
+			logger.Errorf("[transport] failed loading tls config: %s", err)
+			tlsConfig = &tls.Config{ServerName: config.TLSServerName}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if config.ProxyProtocol != "" {
+		transport.DialContext = proxyDialer(dialer, config.ProxyProtocol)
+		transport.DisableKeepAlives = true
+	}
+
+	if config.HTTP2 {
+		transport.Protocols = new(http.Protocols)
+		if config.TLS {
+			transport.Protocols.SetHTTP1(true)
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+
+	return transport
+}
+
+func IsTLS(transport *http.Transport) bool {
+	return transport.TLSClientConfig != nil
+}
+
+func transportChanged(a, b PoolConfig) bool {
+	return a.ConnectTimeout != b.ConnectTimeout || a.KeepAlive != b.KeepAlive ||
+		a.MaxIdleConns != b.MaxIdleConns || a.IdleConnTimeout != b.IdleConnTimeout ||
+		a.ResponseHeaderTimeout != b.ResponseHeaderTimeout || a.DisableKeepAlives != b.DisableKeepAlives ||
+		a.HTTP2 != b.HTTP2 || a.ProxyProtocol != b.ProxyProtocol ||
+		a.TLS != b.TLS || a.TLSCAFile != b.TLSCAFile || a.TLSCertFile != b.TLSCertFile ||
+		a.TLSKeyFile != b.TLSKeyFile || a.TLSServerName != b.TLSServerName || a.TLSVerify != b.TLSVerify
+}
+
+// The transport for new requests.
+func (s *Server) transport() *http.Transport {
+	s.transportLock.RLock()
+	defer s.transportLock.RUnlock()
+
+	return s.Transport
+}
+
+// Requests in flight finish on the old transport, whose connections are
+// closed once idle: right away, after the grace period and, for streams
+// outlasting it, after the idle timeout.
+func (s *Server) setTransport(transport *http.Transport, grace time.Duration) {
+	s.transportLock.Lock()
+	old := s.Transport
+	s.Transport = transport
+	s.transportLock.Unlock()
+
+	old.CloseIdleConnections()
+	time.AfterFunc(grace, old.CloseIdleConnections)
+}
+
+// Verification of backend certificates: the full chain and host name, the
+// chain only (for backends addressed by IP), or none at all.
+const (
+	TLSVerifyFull = "full"
+	TLSVerifyCA   = "ca"
+	TLSVerifyNone = "none"
+)
+
+func IsValidTLSVerify(verify string) bool {
+	switch strings.ToLower(verify) {
+	case TLSVerifyFull, TLSVerifyCA, TLSVerifyNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewTLSConfig loads the CA bundle and client certificate named in config.
+// Backends are verified against the system roots without a CA bundle.
+func NewTLSConfig(config PoolConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.TLSServerName,
+	}
+
+	if config.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.TLSCAFile)
+		}
+	}
+
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch strings.ToLower(config.TLSVerify) {
+	case TLSVerifyNone:
+		tlsConfig.InsecureSkipVerify = true
+	case TLSVerifyCA:
+		// skip the host name check, but still verify the chain
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(raw))
+			for i, der := range raw {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return errors.New("no backend certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(opts)
+			return err
+		}
+	}
+
+	return tlsConfig, nil
+}
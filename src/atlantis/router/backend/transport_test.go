@@ -0,0 +1,268 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/testutils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewTransport(t *testing.T) {
+	transport := NewTransport(PoolConfig{})
+	if transport.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost || transport.IdleConnTimeout != DefaultIdleConnTimeout ||
+		transport.DisableKeepAlives {
+		t.Errorf("should default to keep-alive with idle connections")
+	}
+
+	transport = NewTransport(PoolConfig{
+		MaxIdleConns:          4,
+		IdleConnTimeout:       time.Minute,
+		ResponseHeaderTimeout: time.Second,
+		DisableKeepAlives:     true,
+	})
+	if transport.MaxIdleConnsPerHost != 4 || transport.IdleConnTimeout != time.Minute ||
+		transport.ResponseHeaderTimeout != time.Second || !transport.DisableKeepAlives {
+		t.Errorf("should tune transport as configured")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	backend := testutils.NewBackend(100, false)
+	defer backend.Shutdown()
+
+	server := NewServer(backend.Address())
+	server.Transport = NewTransport(PoolConfig{ResponseHeaderTimeout: 10 * time.Millisecond})
+
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+	server.Handle(logRecord, time.Second)
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("should time out waiting for response headers")
+	}
+}
+
+func TestReconfigureTransport(t *testing.T) {
+	conf := newTestConfig()
+	conf.RequestTimeout = 1 * time.Second
+	backend := testutils.NewBackend(100, false)
+	defer backend.Shutdown()
+	backend.SetResponse(http.StatusOK, "Still here!")
+	pool := newTestPool(t, conf, backend.Address())
+	server := pool.Servers[backend.Address()]
+	conf = pool.Config
+	transport := server.transport()
+
+	done := make(chan int)
+	go func() {
+		logRecord, rr := testutils.NewTestHAProxyLogRecord(backend.URL())
+		pool.Handle(logRecord)
+		done <- rr.Code
+	}()
+	for server.Metrics.Cost() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	pool.Reconfigure(conf)
+	if server.transport() != transport {
+		t.Errorf("should keep transport when unchanged")
+	}
+
+	conf.MaxIdleConns = 4
+	pool.Reconfigure(conf)
+	if server.transport() == transport || server.transport().MaxIdleConnsPerHost != 4 {
+		t.Errorf("should replace transport when changed")
+	}
+	if <-done != http.StatusOK {
+		t.Errorf("should complete requests in flight on the old transport")
+	}
+}
+
+// Writes a self-signed certificate for 127.0.0.1, good for servers, clients
+// and as its own CA, returning the cert and key file names.
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "backend.example.com"},
+		DNSNames:              []string{"backend.example.com"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %s", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func newTLSBackend(t *testing.T, certFile, keyFile string, clientAuth bool) *httptest.Server {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loading certificate: %s", err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server-Status", "OK")
+		w.Write([]byte("Secret!"))
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientAuth {
+		config, _ := NewTLSConfig(PoolConfig{TLSCAFile: certFile})
+		backend.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		backend.TLS.ClientCAs = config.RootCAs
+	}
+	backend.StartTLS()
+	return backend
+}
+
+func tlsRequest(server *Server, url string) int {
+	logRecord, rr := testutils.NewTestHAProxyLogRecord(url)
+	server.Handle(logRecord, time.Second)
+	return rr.Code
+}
+
+func TestTLSVerify(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	backend := newTLSBackend(t, certFile, keyFile, false)
+	defer backend.Close()
+	address := backend.Listener.Addr().String()
+
+	server := NewServer(address)
+	server.Transport = NewTransport(PoolConfig{TLS: true, TLSCAFile: certFile})
+	if code := tlsRequest(server, backend.URL); code != http.StatusOK {
+		t.Errorf("should proxy to tls backend verified by ca")
+	}
+	server.CheckHealth(NewHealthCheck(PoolConfig{}), time.Second)
+	if server.Status.Current != StatusOk {
+		t.Errorf("should check health over tls")
+	}
+
+	server.Transport = NewTransport(PoolConfig{TLS: true})
+	if code := tlsRequest(server, backend.URL); code != http.StatusBadGateway {
+		t.Errorf("should not trust backend without ca")
+	}
+
+	server.Transport = NewTransport(PoolConfig{TLS: true, TLSVerify: TLSVerifyNone})
+	if code := tlsRequest(server, backend.URL); code != http.StatusOK {
+		t.Errorf("should skip verification when configured")
+	}
+
+	config := PoolConfig{TLS: true, TLSCAFile: certFile, TLSServerName: "other.example.com"}
+	server.Transport = NewTransport(config)
+	if code := tlsRequest(server, backend.URL); code != http.StatusBadGateway {
+		t.Errorf("should verify server name")
+	}
+	config.TLSVerify = TLSVerifyCA
+	server.Transport = NewTransport(config)
+	if code := tlsRequest(server, backend.URL); code != http.StatusOK {
+		t.Errorf("should only verify chain when configured")
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	backend := newTLSBackend(t, certFile, keyFile, true)
+	defer backend.Close()
+
+	server := NewServer(backend.Listener.Addr().String())
+	server.Transport = NewTransport(PoolConfig{TLS: true, TLSCAFile: certFile})
+	if code := tlsRequest(server, backend.URL); code != http.StatusBadGateway {
+		t.Errorf("should fail without client certificate")
+	}
+
+	server.Transport = NewTransport(PoolConfig{
+		TLS:         true,
+		TLSCAFile:   certFile,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+	})
+	if code := tlsRequest(server, backend.URL); code != http.StatusOK {
+		t.Errorf("should present client certificate")
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	request := func(server *Server, url string) (string, string) {
+		logRecord, rr := testutils.NewTestHAProxyLogRecord(url)
+		server.Handle(logRecord, time.Second)
+		return rr.Body.String(), logRecord.ServerProto()
+	}
+
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	server := NewServer(h2c.Listener.Addr().String())
+	if proto, _ := request(server, h2c.URL); proto != "HTTP/1.1" {
+		t.Errorf("should default to HTTP/1.1, got %s", proto)
+	}
+	server.Transport = NewTransport(PoolConfig{HTTP2: true})
+	if proto, logged := request(server, h2c.URL); proto != "HTTP/2.0" || logged != "HTTP/2.0" {
+		t.Errorf("should speak h2c when configured, got %s", proto)
+	}
+
+	certFile, keyFile := writeTestCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loading certificate: %s", err)
+	}
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	server = NewServer(h2.Listener.Addr().String())
+	server.Transport = NewTransport(PoolConfig{TLS: true, TLSCAFile: certFile})
+	if proto, _ := request(server, h2.URL); proto != "HTTP/1.1" {
+		t.Errorf("should not negotiate HTTP/2 unless configured, got %s", proto)
+	}
+	server.Transport = NewTransport(PoolConfig{TLS: true, TLSCAFile: certFile, HTTP2: true})
+	if proto, _ := request(server, h2.URL); proto != "HTTP/2.0" {
+		t.Errorf("should negotiate HTTP/2 when configured, got %s", proto)
+	}
+}
@@ -0,0 +1,218 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/logger"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultTunnelIdleTimeout = 5 * time.Minute
+
+// Whether the client asks to switch protocols, as websockets do.
+func IsUpgrade(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && hasToken(req.Header["Connection"], "upgrade")
+}
+
+// Upgraded connections may stay open for long, so they bypass the pool and
+// server queues and are limited by MaxTunnels instead. Returns the status the
+// client got.
+func (p *Pool) tunnel(logRecord *logger.HAProxyLogRecord, pTime time.Time) int {
+	p.RLock()
+	maxTunnels, idle, tout := p.Config.MaxTunnels, p.Config.TunnelIdleTimeout, p.Config.RequestTimeout
+	sticky := p.Config.StickyCookie
+	p.RUnlock()
+
+	tunnels := atomic.AddInt32(&p.tunnels, 1)
+	defer atomic.AddInt32(&p.tunnels, -1)
+	logRecord.PoolUpdateRecord(p.Name, p.Metrics.GetActiveConnections(), 0, pTime)
+	if maxTunnels > 0 && int(tunnels) > maxTunnels {
+		logRecord.Debugf("[pool %s] too many tunnels", p.Name)
+		logRecord.Error(logger.ServiceUnavailableMsg, http.StatusServiceUnavailable)
+		logRecord.Terminate("Pool: too many tunnels")
+		return http.StatusServiceUnavailable
+	}
+
+	server := p.allow(logRecord.Request, p.pick(logRecord, sticky), map[*Server]bool{})
+	if server == nil {
+		logRecord.Printf("[pool %s] no server", p.Name)
+		logRecord.Error(logger.ServiceUnavailableMsg, http.StatusServiceUnavailable)
+		logRecord.Terminate("Pool: " + logger.ServiceUnavailableMsg)
+		return http.StatusServiceUnavailable
+	}
+	if sticky != "" {
+		// tunnels aren't retried
+		stick(logRecord, sticky, server)
+	}
+
+	if idle == 0 {
+		idle = DefaultTunnelIdleTimeout
+	}
+	return server.Tunnel(logRecord, tout, idle)
+}
+
+func (p *Pool) Tunnels() int {
+	return int(atomic.LoadInt32(&p.tunnels))
+}
+
+// Tunnel sends an upgrade request and, when the server switches protocols,
+// hijacks the client connection and splices bytes both ways until either side
+// is done, nothing passes for the idle timeout, or draining the server times
+// out. The request is logged once the tunnel closes. Returns the status the
+// client got.
+func (s *Server) Tunnel(logRecord *logger.HAProxyLogRecord, tout, idle time.Duration) int {
+	sTime := time.Now()
+	s.Metrics.RequestStart()
+	defer s.Metrics.RequestDone()
+
+	sanitizeRequest(logRecord.Request)
+	forwarded(logRecord.Request)
+	logRecord.ServerUpdateRecord(s.Address, 0, s.Metrics.Cost(), sTime)
+	// the handshake only, not the life of the tunnel
+	span := s.startSpan(logRecord, "upgrade")
+	resErrCh := make(chan ResponseError)
+	req, cancelAttempt := withCancel(logRecord.Request)
+	defer cancelAttempt(nil)
+	tstart := time.Now()
+	go s.roundTrip(s.transport(), req, resErrCh)
+
+	var resErr ResponseError
+	timeout := time.After(tout)
+	cancel := s.cancel
+wait:
+	for {
+		select {
+		case resErr = <-resErrCh:
+			break wait
+		case <-timeout:
+			cancelAttempt(errResponseTimeout)
+		case <-cancel:
+			cancelAttempt(errDrainTimeout)
+			cancel = nil
+		}
+	}
+	logRecord.UpdateTr(tstart, time.Now())
+	span.SetResult(resErr.Response, resErr.Error)
+	span.Finish()
+	s.observe(resErr, time.Since(tstart))
+	if resErr.Error != nil {
+		s.fail(logRecord, resErr.Error)
+		return logRecord.GetResponseStatusCode()
+	}
+
+	res := resErr.Response
+	defer res.Body.Close()
+	logRecord.SetServerProto(res.Proto)
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// the server declined, answer as any other request
+		removeHopHeaders(res.Header)
+		logRecord.CopyHeaders(res.Header)
+		logRecord.WriteHeader(res.StatusCode)
+		if err := logRecord.Copy(res.Body); err != nil {
+			logRecord.Errorf("[server %s] failed attempting to copy response body: %s\n", s.Address, err)
+		} else {
+			logRecord.Log()
+		}
+		return res.StatusCode
+	}
+
+	backend, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		s.fail(logRecord, errors.New("upgraded connection is not writable"))
+		return http.StatusBadGateway
+	}
+	conn, brw, err := http.NewResponseController(logRecord.ResponseWriter).Hijack()
+	if err != nil {
+		s.fail(logRecord, err)
+		return http.StatusBadGateway
+	}
+	defer conn.Close()
+	// port read and write timeouts are for requests, not tunnels
+	conn.SetDeadline(time.Time{})
+
+	// the response bypasses the response writer, so headers staged on it are
+	// merged in, our request ID echoed rather than the server's
+	staged := logRecord.ResponseWriter.Header().Clone()
+	removeHopHeaders(staged)
+	for hdr, vals := range staged {
+		if hdr == logger.RequestIDHeader {
+			res.Header.Del(hdr)
+		}
+		for _, val := range vals {
+			res.Header.Add(hdr, val)
+		}
+	}
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		logRecord.Errorf("[server %s] failed writing upgrade response: %s\n", s.Address, err)
+		return http.StatusSwitchingProtocols
+	}
+	brw.Flush()
+
+	// traffic either way pushes back the idle timeout, which may then fire
+	// again, so it never blocks nor closes the channel
+	idleCh := make(chan bool, 1)
+	timer := time.AfterFunc(idle, func() {
+		select {
+		case idleCh <- true:
+		default:
+		}
+	})
+	defer timer.Stop()
+
+	upDone, downDone := make(chan bool), make(chan bool)
+	var down int64
+	go func() {
+		io.Copy(backend, idleReader{brw.Reader, timer, idle})
+		close(upDone)
+	}()
+	go func() {
+		down, _ = io.Copy(conn, idleReader{backend, timer, idle})
+		close(downDone)
+	}()
+
+	state := "Server: tunnel closed"
+	select {
+	case <-upDone:
+	case <-downDone:
+	case <-idleCh:
+		state = "Server: tunnel idle"
+	case <-cancel:
+		state = "Server: tunnel cancelled"
+	}
+	conn.Close()
+	backend.Close()
+	<-upDone
+	<-downDone
+
+	logRecord.Tunneled(http.StatusSwitchingProtocols, down)
+	logRecord.Terminate(state)
+	return http.StatusSwitchingProtocols
+}
+
+type idleReader struct {
+	io.Reader
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.idle)
+	}
+	return n, err
+}
@@ -0,0 +1,243 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package backend
+
+import (
+	"atlantis/router/logger"
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Switches protocols when asked to and echoes whatever it reads.
+func newEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			w.Header().Set("Server-Status", StatusOk)
+			return
+		}
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "no upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n" +
+			"X-Request-Id: Pluto\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+// Serves the pool like a router port would.
+func newFrontend(pool *Pool, records chan *logger.HAProxyLogRecord) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logRecord := logger.NewHAProxyLogRecord(w, r, "test", 0, time.Now())
+		if id := r.Header.Get(logger.RequestIDHeader); id != "" {
+			logRecord.SetRequestID(id)
+		}
+		pool.Handle(&logRecord)
+		if records != nil {
+			records <- &logRecord
+		}
+	}))
+}
+
+// Headers are sent along as "Name: value" lines.
+func dialUpgrade(t *testing.T, url, protocol string, headers ...string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("failed to dial: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n" +
+		strings.Join(append(headers, ""), "\r\n") + "\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	return conn, br, res
+}
+
+func TestIsUpgrade(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://test/", nil)
+	if IsUpgrade(req) {
+		t.Errorf("should not upgrade plain requests")
+	}
+	req.Header.Set("Upgrade", "websocket")
+	if IsUpgrade(req) {
+		t.Errorf("should not upgrade without connection upgrade")
+	}
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	if !IsUpgrade(req) {
+		t.Errorf("should upgrade")
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+	pool := newTestPool(t, newTestConfig(), backend.Listener.Addr().String())
+	records := make(chan *logger.HAProxyLogRecord, 1)
+	frontend := newFrontend(pool, records)
+	defer frontend.Close()
+
+	conn, br, res := dialUpgrade(t, frontend.URL, "echo")
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("should switch protocols, got %d", res.StatusCode)
+	}
+	// well past the request timeout
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte("Mickey Mouse!\n"))
+	line, err := br.ReadString('\n')
+	if err != nil || line != "Mickey Mouse!\n" {
+		t.Errorf("should echo through the tunnel, got %q: %v", line, err)
+	}
+	if pool.Tunnels() != 1 {
+		t.Errorf("should count open tunnels, got %d", pool.Tunnels())
+	}
+	conn.Close()
+
+	select {
+	case logRecord := <-records:
+		if logRecord.GetResponseStatusCode() != http.StatusSwitchingProtocols {
+			t.Errorf("should log tunnel on close")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("should close tunnel with the client")
+	}
+	if pool.Tunnels() != 0 {
+		t.Errorf("should count closed tunnels, got %d", pool.Tunnels())
+	}
+}
+
+func TestTunnelIdle(t *testing.T) {
+	config := newTestConfig()
+	config.TunnelIdleTimeout = 50 * time.Millisecond
+	backend := newEchoServer()
+	defer backend.Close()
+	pool := newTestPool(t, config, backend.Listener.Addr().String())
+	frontend := newFrontend(pool, nil)
+	defer frontend.Close()
+
+	conn, br, res := dialUpgrade(t, frontend.URL, "echo")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("should switch protocols, got %d", res.StatusCode)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("should close idle tunnel, got %v", err)
+	}
+}
+
+func TestTunnelMax(t *testing.T) {
+	config := newTestConfig()
+	config.MaxTunnels = 1
+	backend := newEchoServer()
+	defer backend.Close()
+	pool := newTestPool(t, config, backend.Listener.Addr().String())
+	frontend := newFrontend(pool, nil)
+	defer frontend.Close()
+
+	conn, _, res := dialUpgrade(t, frontend.URL, "echo")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("should switch protocols, got %d", res.StatusCode)
+	}
+	conn2, _, res := dialUpgrade(t, frontend.URL, "echo")
+	defer conn2.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("should limit tunnels, got %d", res.StatusCode)
+	}
+
+	var out bytes.Buffer
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	logRecord := logger.NewShallowHAProxyLogRecord(nil, httptest.NewRecorder(), req)
+	logRecord.SetLogger(log.New(&out, "", 0))
+	pool.Handle(logRecord)
+	if tw, tt := loggedTimes(out.String(), http.StatusServiceUnavailable); tw == "" || tw[0] == '-' || tt[0] == '-' {
+		t.Errorf("should log times of tunnels turned away, got %s", out.String())
+	}
+}
+
+func TestTunnelDeclined(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+	pool := newTestPool(t, newTestConfig(), backend.Listener.Addr().String())
+	frontend := newFrontend(pool, nil)
+	defer frontend.Close()
+
+	conn, _, res := dialUpgrade(t, frontend.URL, "other")
+	defer conn.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("should pass declined upgrades on, got %d", res.StatusCode)
+	}
+}
+
+func TestTunnelHeaders(t *testing.T) {
+	backend := newEchoServer()
+	defer backend.Close()
+	pool := newTestPool(t, newTestConfig(), backend.Listener.Addr().String())
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Staged", "Goofy")
+		w.Header().Set("Connection", "close")
+		logRecord := logger.NewHAProxyLogRecord(w, r, "test", 0, time.Now())
+		pool.Handle(&logRecord)
+	}))
+	defer frontend.Close()
+
+	conn, _, res := dialUpgrade(t, frontend.URL, "echo")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("should switch protocols, got %d", res.StatusCode)
+	}
+	if res.Header.Get("X-Staged") != "Goofy" {
+		t.Errorf("should send headers staged before the upgrade")
+	}
+	if connection := res.Header["Connection"]; len(connection) != 1 || connection[0] != "Upgrade" {
+		t.Errorf("should keep hop-by-hop headers of the server, got %v", connection)
+	}
+}
+
+func TestTunnelSticky(t *testing.T) {
+	config := newTestConfig()
+	config.StickyCookie = "ROUTERID"
+	backend := newEchoServer()
+	defer backend.Close()
+	pool := newTestPool(t, config, backend.Listener.Addr().String())
+	frontend := newFrontend(pool, nil)
+	defer frontend.Close()
+
+	conn, _, res := dialUpgrade(t, frontend.URL, "echo")
+	defer conn.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("should switch protocols, got %d", res.StatusCode)
+	}
+	server := pool.Servers[strings.TrimPrefix(backend.URL, "http://")]
+	cookies := res.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "ROUTERID" || cookies[0].Value != StickyValue(server) {
+		t.Errorf("should pin websocket clients to the server, got %v", cookies)
+	}
+}
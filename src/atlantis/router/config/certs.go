@@ -0,0 +1,231 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"atlantis/router/logger"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Served to clients without SNI, or asking for a hostname no certificate has.
+const DefaultCertName = "default"
+
+const DefaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func IsValidTLSVersion(version string) bool {
+	_, ok := tlsVersions[version]
+	return ok
+}
+
+// Cipher suites by their standard names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+// These only apply up to TLS 1.2, the TLS 1.3 suites are not configurable.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not valid cipher suite", name)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no cipher suites")
+	}
+	return ids, nil
+}
+
+// A CertStore holds certificates for HTTPS ports by name, and looks them up
+// by the hostnames they are valid for. Certificates are swapped under the
+// lock, so changes apply to the next handshake without touching listeners.
+type CertStore struct {
+	sync.RWMutex
+	certs map[string]*tls.Certificate
+	hosts map[string]*tls.Certificate
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{
+		certs: map[string]*tls.Certificate{},
+		hosts: map[string]*tls.Certificate{},
+	}
+}
+
+// ParseCert parses a PEM encoded certificate chain and private key.
+func ParseCert(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// LoadCertDir loads every <name>.crt and <name>.key pair in dir. Pairs which
+// fail to load are skipped.
+func LoadCertDir(dir string) (map[string]*tls.Certificate, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	certs := map[string]*tls.Certificate{}
+	for _, certFile := range files {
+		name := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			logger.Errorf("[certs %s] %s", dir, err)
+			continue
+		}
+		keyPEM, err := ioutil.ReadFile(filepath.Join(dir, name+".key"))
+		if err != nil {
+			logger.Errorf("[certs %s] %s", dir, err)
+			continue
+		}
+		cert, err := ParseCert(certPEM, keyPEM)
+		if err != nil {
+			logger.Errorf("[certs %s] %s failed to load: %s", dir, name, err)
+			continue
+		}
+		certs[name] = cert
+	}
+	return certs, nil
+}
+
+func (s *CertStore) Add(name string, cert *tls.Certificate) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.certs[name] = cert
+	s.index()
+}
+
+func (s *CertStore) Del(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.certs, name)
+	s.index()
+}
+
+// Replace swaps all certificates at once, as when reloading a directory.
+func (s *CertStore) Replace(certs map[string]*tls.Certificate) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.certs = certs
+	s.index()
+}
+
+func (s *CertStore) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.certs)
+}
+
+// Must be called holding lock on store. Where certificates share a hostname,
+// the one first by name wins.
+func (s *CertStore) index() {
+	names := make([]string, 0, len(s.certs))
+	for name := range s.certs {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	s.hosts = map[string]*tls.Certificate{}
+	for _, name := range names {
+		cert := s.certs[name]
+		hosts := cert.Leaf.DNSNames
+		if len(hosts) == 0 && cert.Leaf.Subject.CommonName != "" {
+			hosts = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, host := range hosts {
+			s.hosts[strings.ToLower(host)] = cert
+		}
+	}
+}
+
+// Get returns the certificate for hostname, matching wildcard certificates one
+// label deep, or nil if there is none.
+func (s *CertStore) Get(hostname string) *tls.Certificate {
+	s.RLock()
+	defer s.RUnlock()
+
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if cert, ok := s.hosts[hostname]; ok {
+		return cert
+	}
+	if i := strings.Index(hostname, "."); i > 0 {
+		if cert, ok := s.hosts["*"+hostname[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+func (s *CertStore) Default() *tls.Certificate {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.certs[DefaultCertName]
+}
+
+// LookupCert tries the stores in order for the hostname, then for a default.
+// Nil stores are skipped.
+func LookupCert(hostname string, stores ...*CertStore) (*tls.Certificate, error) {
+	if hostname != "" {
+		for _, store := range stores {
+			if store == nil {
+				continue
+			}
+			if cert := store.Get(hostname); cert != nil {
+				return cert, nil
+			}
+		}
+	}
+	for _, store := range stores {
+		if store == nil {
+			continue
+		}
+		if cert := store.Default(); cert != nil {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("no certificate for %q", hostname)
+}
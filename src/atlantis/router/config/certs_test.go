@@ -0,0 +1,147 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCertPEM(t *testing.T, hosts ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func testCert(t *testing.T, hosts ...string) *tls.Certificate {
+	certPEM, keyPEM := testCertPEM(t, hosts...)
+	cert, err := ParseCert(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("parsing certificate: %s", err)
+	}
+	return cert
+}
+
+func TestCertStore(t *testing.T) {
+	store := NewCertStore()
+	www := testCert(t, "www.example.com")
+	wild := testCert(t, "*.example.com")
+	store.Add("www", www)
+	store.Add("wild", wild)
+
+	if store.Get("WWW.example.com.") != www {
+		t.Errorf("should match hostname exactly first")
+	}
+	if store.Get("api.example.com") != wild || store.Get("a.b.example.com") != nil {
+		t.Errorf("should match wildcard one label deep")
+	}
+	if _, err := LookupCert("www.ooyala.com", store); err == nil {
+		t.Errorf("should fail without default certificate")
+	}
+
+	fallback := testCert(t, "localhost")
+	store.Add(DefaultCertName, fallback)
+	if cert, _ := LookupCert("www.ooyala.com", nil, store); cert != fallback {
+		t.Errorf("should fall back to default certificate")
+	}
+
+	store.Del("www")
+	if store.Get("www.example.com") != wild {
+		t.Errorf("should stop serving deleted certificate")
+	}
+}
+
+func TestLookupCertOrder(t *testing.T) {
+	port, global := NewCertStore(), NewCertStore()
+	ours := testCert(t, "www.example.com")
+	port.Add("www", ours)
+	global.Add("www", testCert(t, "www.example.com"))
+	global.Add("api", testCert(t, "api.example.com"))
+
+	if cert, _ := LookupCert("www.example.com", port, global); cert != ours {
+		t.Errorf("should prefer certificates of earlier stores")
+	}
+	if cert, _ := LookupCert("api.example.com", port, global); cert == nil {
+		t.Errorf("should look through all stores")
+	}
+}
+
+func TestLoadCertDir(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := testCertPEM(t, "www.example.com")
+	ioutil.WriteFile(filepath.Join(dir, "www.crt"), certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "www.key"), keyPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "broken.crt"), certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "broken.key"), []byte("Jupiter"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "lonely.crt"), certPEM, 0600)
+
+	certs, err := LoadCertDir(dir)
+	if err != nil {
+		t.Fatalf("should load certificate directory: %s", err)
+	}
+	if len(certs) != 1 || certs["www"] == nil || certs["www"].Leaf.DNSNames[0] != "www.example.com" {
+		t.Errorf("should load valid pairs only")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	if err != nil || len(ids) != 2 || ids[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("should parse cipher suites in order")
+	}
+	if _, err := ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Errorf("should reject insecure cipher suites")
+	}
+	if _, err := ParseCipherSuites(" , "); err == nil {
+		t.Errorf("should reject empty cipher suites")
+	}
+}
+
+func TestCertEquals(t *testing.T) {
+	cert := Cert{Name: "www", Cert: "cert pem", Key: "key pem"}
+	if !cert.Equals(Cert{Name: "www", Cert: "cert pem", Key: "key pem"}) {
+		t.Errorf("should equal identical cert")
+	}
+	if cert.Equals(Cert{Name: "www", Cert: "new cert pem", Key: "new key pem"}) {
+		t.Errorf("should not equal rotated cert of same name")
+	}
+}
@@ -28,6 +28,7 @@ type Config struct {
 	Rules          map[string]*routing.Rule
 	Tries          map[string]*routing.Trie
 	Ports          map[uint16]*routing.Trie
+	Certs          *CertStore
 }
 
 func NewConfig(matcherFactory *routing.MatcherFactory) *Config {
@@ -37,6 +38,7 @@ func NewConfig(matcherFactory *routing.MatcherFactory) *Config {
 		Rules:          make(map[string]*routing.Rule, 1024),
 		Tries:          make(map[string]*routing.Trie, 128),
 		Ports:          make(map[uint16]*routing.Trie, 32),
+		Certs:          NewCertStore(),
 	}
 }
 
@@ -287,3 +289,20 @@ func (c *Config) DelPort(num uint16) {
 
 	delete(c.Ports, num)
 }
+
+func (c *Config) AddCert(cert Cert) {
+	parsed, err := ParseCert([]byte(cert.Cert), []byte(cert.Key))
+	if err != nil {
+		logger.Errorf("[cert %s] failed to load: %s", cert.Name, err)
+		return
+	}
+	c.Certs.Add(cert.Name, parsed)
+}
+
+func (c *Config) UpdateCert(cert Cert) {
+	c.AddCert(cert)
+}
+
+func (c *Config) DelCert(name string) {
+	c.Certs.Del(name)
+}
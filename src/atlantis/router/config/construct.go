@@ -15,6 +15,9 @@ import (
 	"atlantis/router/backend"
 	"atlantis/router/logger"
 	"atlantis/router/routing"
+	"crypto/tls"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -24,8 +27,49 @@ const (
 	defaultRequestTimeout = 1 * time.Minute
 )
 
-func (c *Config) ConstructServer(host Host) *backend.Server {
-	return backend.NewServer(host.Address)
+func (c *Config) ConstructServerConfig(host Host) backend.ServerConfig {
+	weight := host.Weight
+	if weight == 0 {
+		weight = backend.DefaultWeight
+	}
+
+	tags := make(map[string]string, len(host.Tags))
+	for key, val := range host.Tags {
+		tags[key] = val
+	}
+
+	maxConn := host.MaxConn
+	if maxConn < 0 {
+		logger.Errorf("[config %s] %d is not valid max conn", host.Address, host.MaxConn)
+		maxConn = 0
+	}
+
+	return backend.ServerConfig{
+		Weight:  weight,
+		Zone:    host.Zone,
+		Tags:    tags,
+		MaxConn: maxConn,
+	}
+}
+
+func (c *Config) ConstructServer(host Host, config backend.PoolConfig) *backend.Server {
+	server := backend.NewServer(host.Address)
+	server.Config = c.ConstructServerConfig(host)
+	server.Transport = backend.NewTransport(config)
+	return server
+}
+
+// Optional durations are zero when absent or invalid.
+func parseOptionalDuration(name, duration string) time.Duration {
+	if duration == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d < 0 {
+		logger.Errorf("[config %s] %s is not valid duration", name, duration)
+		return 0
+	}
+	return d
 }
 
 func (c *Config) ConstructPoolConfig(pool Pool) backend.PoolConfig {
@@ -55,12 +99,370 @@ func (c *Config) ConstructPoolConfig(pool Pool) backend.PoolConfig {
 		status = "OK"
 	}
 
+	slowStart := backend.Tstartup * time.Second
+	if config.SlowStart != "" {
+		slowStart, err = time.ParseDuration(config.SlowStart)
+		if err != nil || slowStart < 0 {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.SlowStart)
+			slowStart = backend.Tstartup * time.Second
+		}
+	}
+
+	slowStartCurve := config.SlowStartCurve
+	if slowStartCurve == "" {
+		slowStartCurve = backend.SlowStartHyperbolic
+	} else if !backend.IsValidSlowStartCurve(slowStartCurve) {
+		logger.Errorf("[config %s] %s is not valid slow start curve", name, config.SlowStartCurve)
+		slowStartCurve = backend.SlowStartHyperbolic
+	}
+	if slowStart == 0 {
+		slowStartCurve = backend.SlowStartNone
+	}
+
+	healthzMode := config.HealthzMode
+	if healthzMode == "" {
+		healthzMode = backend.HealthzHTTP
+	} else if !backend.IsValidHealthzMode(healthzMode) {
+		logger.Errorf("[config %s] %s is not valid healthz mode", name, config.HealthzMode)
+		healthzMode = backend.HealthzHTTP
+	}
+	if strings.EqualFold(healthzMode, backend.HealthzGRPC) && !config.HTTP2 {
+		logger.Errorf("[config %s] grpc health checks need HTTP2 to servers", name)
+	}
+
+	proxyProtocol := strings.ToLower(config.ProxyProtocol)
+	if proxyProtocol != "" && !backend.IsValidProxyProtocol(proxyProtocol) {
+		logger.Errorf("[config %s] %s is not valid proxy protocol", name, config.ProxyProtocol)
+		proxyProtocol = ""
+	}
+
+	healthzPath := config.HealthzPath
+	if healthzPath != "" && !strings.HasPrefix(healthzPath, "/") {
+		logger.Errorf("[config %s] %s is not valid healthz path", name, config.HealthzPath)
+		healthzPath = backend.DefaultHealthzPath
+	}
+
+	healthzMethod := config.HealthzMethod
+	if strings.ContainsAny(healthzMethod, " \t\r\n\"(),/:;<=>?@[\\]{}") {
+		logger.Errorf("[config %s] %s is not valid healthz method", name, config.HealthzMethod)
+		healthzMethod = backend.DefaultHealthzMethod
+	}
+
+	healthzExpect := config.HealthzExpect
+	if healthzExpect != "" && !backend.IsValidHealthzExpect(healthzExpect) {
+		logger.Errorf("[config %s] %s is not valid healthz expected status", name, config.HealthzExpect)
+		healthzExpect = ""
+	}
+
+	healthzRise := config.HealthzRise
+	if healthzRise < 0 {
+		logger.Errorf("[config %s] %d is not valid healthz rise", name, config.HealthzRise)
+		healthzRise = backend.DefaultHealthzRise
+	}
+
+	healthzFall := config.HealthzFall
+	if healthzFall < 0 {
+		logger.Errorf("[config %s] %d is not valid healthz fall", name, config.HealthzFall)
+		healthzFall = backend.DefaultHealthzFall
+	}
+
+	healthzJitter := config.HealthzJitter
+	if healthzJitter < 0 || healthzJitter > 100 {
+		logger.Errorf("[config %s] %d is not valid healthz jitter", name, config.HealthzJitter)
+		healthzJitter = 0
+	}
+
+	balancer := config.Balancer
+	if balancer == "" {
+		balancer = backend.BalanceLeastConn
+	} else if !backend.IsValidBalancer(balancer) {
+		logger.Errorf("[config %s] %s is not valid balancer", name, config.Balancer)
+		balancer = backend.BalanceLeastConn
+	}
+
+	hashKey := config.HashKey
+	if strings.EqualFold(balancer, backend.BalanceHash) && !backend.IsValidHashKey(hashKey) {
+		logger.Errorf("[config %s] %s is not valid hash key", name, config.HashKey)
+		balancer, hashKey = backend.BalanceLeastConn, ""
+	}
+
+	stickyCookie := config.StickyCookie
+	if strings.ContainsAny(stickyCookie, " \t\r\n\"(),/:;<=>?@[\\]{}") {
+		logger.Errorf("[config %s] %s is not valid cookie name", name, config.StickyCookie)
+		stickyCookie = ""
+	}
+
+	maxConn := config.MaxConn
+	if maxConn < 0 {
+		logger.Errorf("[config %s] %d is not valid max conn", name, config.MaxConn)
+		maxConn = 0
+	}
+
+	serverMaxConn := config.ServerMaxConn
+	if serverMaxConn < 0 {
+		logger.Errorf("[config %s] %d is not valid server max conn", name, config.ServerMaxConn)
+		serverMaxConn = 0
+	}
+
+	maxQueueTime := backend.DefaultMaxQueueTime
+	if config.MaxQueueTime != "" {
+		maxQueueTime, err = time.ParseDuration(config.MaxQueueTime)
+		if err != nil || maxQueueTime <= 0 {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.MaxQueueTime)
+			maxQueueTime = backend.DefaultMaxQueueTime
+		}
+	}
+
+	drainTimeout := backend.DefaultDrainTimeout
+	if config.DrainTimeout != "" {
+		drainTimeout, err = time.ParseDuration(config.DrainTimeout)
+		if err != nil || drainTimeout < 0 {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.DrainTimeout)
+			drainTimeout = backend.DefaultDrainTimeout
+		}
+	}
+
+	maxTunnels := config.MaxTunnels
+	if maxTunnels < 0 {
+		logger.Errorf("[config %s] %d is not valid max tunnels", name, config.MaxTunnels)
+		maxTunnels = 0
+	}
+
+	tunnelIdleTimeout := backend.DefaultTunnelIdleTimeout
+	if config.TunnelIdleTimeout != "" {
+		tunnelIdleTimeout, err = time.ParseDuration(config.TunnelIdleTimeout)
+		if err != nil || tunnelIdleTimeout <= 0 {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.TunnelIdleTimeout)
+			tunnelIdleTimeout = backend.DefaultTunnelIdleTimeout
+		}
+	}
+
+	// negative intervals are valid, unlike other durations
+	var flushInterval time.Duration
+	if config.FlushInterval != "" {
+		flushInterval, err = time.ParseDuration(config.FlushInterval)
+		if err != nil {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.FlushInterval)
+			flushInterval = 0
+		}
+	}
+
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns < 0 {
+		logger.Errorf("[config %s] %d is not valid max idle conns", name, config.MaxIdleConns)
+		maxIdleConns = backend.DefaultMaxIdleConnsPerHost
+	}
+
+	tlsVerify := config.TLSVerify
+	if tlsVerify == "" {
+		tlsVerify = backend.TLSVerifyFull
+	} else if !backend.IsValidTLSVerify(tlsVerify) {
+		logger.Errorf("[config %s] %s is not valid tls verification", name, config.TLSVerify)
+		tlsVerify = backend.TLSVerifyFull
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		logger.Errorf("[config %s] tls client certificate needs both cert and key file", name)
+	}
+
+	maxAttempts := config.MaxAttempts
+	if maxAttempts < 0 {
+		logger.Errorf("[config %s] %d is not valid max attempts", name, config.MaxAttempts)
+		maxAttempts = 0
+	}
+
+	retryOn := config.RetryOn
+	if retryOn != "" && !backend.IsValidRetryOn(retryOn) {
+		logger.Errorf("[config %s] %s is not valid retry condition", name, config.RetryOn)
+		retryOn = backend.DefaultRetryOn
+	}
+
+	retryBudget := config.RetryBudget
+	if retryBudget < 0 || retryBudget > 100 {
+		logger.Errorf("[config %s] %d is not valid retry budget", name, config.RetryBudget)
+		retryBudget = backend.DefaultRetryBudget
+	}
+
+	ejectionTime := backend.DefaultEjectionTime
+	if config.OutlierEjectionTime != "" {
+		ejectionTime, err = time.ParseDuration(config.OutlierEjectionTime)
+		if err != nil {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.OutlierEjectionTime)
+			ejectionTime = backend.DefaultEjectionTime
+		}
+	}
+
+	maxEjectionPercent := config.OutlierMaxEjectionPercent
+	if maxEjectionPercent < 0 || maxEjectionPercent > 100 {
+		logger.Errorf("[config %s] %d is not valid max ejection percent", name, config.OutlierMaxEjectionPercent)
+		maxEjectionPercent = backend.DefaultMaxEjectionPercent
+	}
+
+	breakerErrorRate := config.BreakerErrorRate
+	if breakerErrorRate < 0 || breakerErrorRate > 100 {
+		logger.Errorf("[config %s] %d is not valid breaker error rate", name, config.BreakerErrorRate)
+		breakerErrorRate = 0
+	}
+
+	breakerMinRequests := config.BreakerMinRequests
+	if breakerMinRequests < 0 {
+		logger.Errorf("[config %s] %d is not valid breaker min requests", name, config.BreakerMinRequests)
+		breakerMinRequests = backend.DefaultBreakerMinRequests
+	}
+
+	breakerWindow := backend.DefaultBreakerWindow
+	if config.BreakerWindow != "" {
+		breakerWindow, err = time.ParseDuration(config.BreakerWindow)
+		if err != nil || breakerWindow <= 0 {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.BreakerWindow)
+			breakerWindow = backend.DefaultBreakerWindow
+		}
+	}
+
+	breakerOpenTime := backend.DefaultBreakerOpenTime
+	if config.BreakerOpenTime != "" {
+		breakerOpenTime, err = time.ParseDuration(config.BreakerOpenTime)
+		if err != nil || breakerOpenTime <= 0 {
+			logger.Errorf("[config %s] %s is not valid duration", name, config.BreakerOpenTime)
+			breakerOpenTime = backend.DefaultBreakerOpenTime
+		}
+	}
+
 	return backend.PoolConfig{
 		HealthzEvery:   healthzEvery,
 		HealthzTimeout: healthzTimeout,
 		RequestTimeout: requestTimeout,
 		Status:         status,
+		SlowStart:      slowStart,
+		SlowStartCurve: slowStartCurve,
+		Balancer:       balancer,
+		HashKey:        hashKey,
+		StickyCookie:   stickyCookie,
+
+		MaxConn:       maxConn,
+		ServerMaxConn: serverMaxConn,
+		MaxQueueTime:  maxQueueTime,
+		DrainTimeout:  drainTimeout,
+
+		MaxTunnels:        maxTunnels,
+		TunnelIdleTimeout: tunnelIdleTimeout,
+		FlushInterval:     flushInterval,
+
+		ConnectTimeout:        parseOptionalDuration(name, config.ConnectTimeout),
+		KeepAlive:             parseOptionalDuration(name, config.KeepAlive),
+		MaxIdleConns:          maxIdleConns,
+		IdleConnTimeout:       parseOptionalDuration(name, config.IdleConnTimeout),
+		ResponseHeaderTimeout: parseOptionalDuration(name, config.ResponseHeaderTimeout),
+		DisableKeepAlives:     config.DisableKeepAlives,
+		HTTP2:                 config.HTTP2,
+		ProxyProtocol:         proxyProtocol,
+
+		TLS:           config.TLS,
+		TLSCAFile:     config.TLSCAFile,
+		TLSCertFile:   config.TLSCertFile,
+		TLSKeyFile:    config.TLSKeyFile,
+		TLSServerName: config.TLSServerName,
+		TLSVerify:     tlsVerify,
+
+		HealthzMode:    healthzMode,
+		HealthzPath:    healthzPath,
+		HealthzMethod:  healthzMethod,
+		HealthzHost:    config.HealthzHost,
+		HealthzExpect:  healthzExpect,
+		HealthzBody:    config.HealthzBody,
+		HealthzRise:    healthzRise,
+		HealthzFall:    healthzFall,
+		HealthzJitter:  healthzJitter,
+		HealthzService: config.HealthzService,
+
+		MaxAttempts:        maxAttempts,
+		RetryOn:            retryOn,
+		RetryNonIdempotent: config.RetryNonIdempotent,
+		RetryBudget:        retryBudget,
+
+		OutlierConsecutive5xx:     config.OutlierConsecutive5xx,
+		OutlierConsecutiveErrors:  config.OutlierConsecutiveErrors,
+		OutlierLatencyFactor:      config.OutlierLatencyFactor,
+		OutlierEjectionTime:       ejectionTime,
+		OutlierMaxEjectionPercent: maxEjectionPercent,
+
+		BreakerErrorRate:   breakerErrorRate,
+		BreakerMinRequests: breakerMinRequests,
+		BreakerWindow:      breakerWindow,
+		BreakerOpenTime:    breakerOpenTime,
+		BreakerServers:     config.BreakerServers,
+	}
+}
+
+// ConstructTLSConfig builds the TLS policy of an HTTPS port, which serves
+// certificates from certs, the port's own, before those in c.Certs.
+func (c *Config) ConstructTLSConfig(port Port, certs *CertStore) *tls.Config {
+	minVersion := port.TLSMinVersion
+	if minVersion == "" {
+		minVersion = DefaultTLSMinVersion
+	} else if !IsValidTLSVersion(minVersion) {
+		logger.Errorf("[port %d] %s is not valid tls version", port.Port, port.TLSMinVersion)
+		minVersion = DefaultTLSMinVersion
+	}
+
+	var ciphers []uint16
+	if port.TLSCiphers != "" {
+		var err error
+		ciphers, err = ParseCipherSuites(port.TLSCiphers)
+		if err != nil {
+			logger.Errorf("[port %d] %s, using default cipher suites", port.Port, err)
+			ciphers = nil
+		}
+	}
+
+	nextProtos := []string{"http/1.1"}
+	if port.HTTP2 {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+
+	stores := []*CertStore{certs, c.Certs}
+	return &tls.Config{
+		MinVersion:   tlsVersions[minVersion],
+		CipherSuites: ciphers,
+		NextProtos:   nextProtos,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return LookupCert(hello.ServerName, stores...)
+		},
+	}
+}
+
+// ConstructProxyTrusted returns the load balancers trusted to send PROXY
+// protocol headers to a port, nil for none. Invalid entries are left out,
+// trusting fewer rather than all.
+func (c *Config) ConstructProxyTrusted(port Port) []*net.IPNet {
+	if port.ProxyProtocol && port.ProxyTrusted == "" {
+		logger.Errorf("[port %d] ProxyProtocol without ProxyTrusted, no PROXY headers are accepted", port.Port)
+	}
+	return parseTrusted(port.Port, port.ProxyTrusted)
+}
+
+// ConstructForwardedTrusted returns the proxies whose forwarding headers a
+// port keeps, as ConstructProxyTrusted does.
+func (c *Config) ConstructForwardedTrusted(port Port) []*net.IPNet {
+	return parseTrusted(port.Port, port.ForwardedTrusted)
+}
+
+// ConstructTraceSampleRate returns the share of new traces a port samples,
+// none if it is not between 0 and 1.
+func (c *Config) ConstructTraceSampleRate(port Port) float64 {
+	if port.TraceSampleRate < 0 || port.TraceSampleRate > 1 {
+		logger.Errorf("[port %d] %g is not valid trace sample rate", port.Port, port.TraceSampleRate)
+		return 0
+	}
+	return port.TraceSampleRate
+}
+
+func parseTrusted(port uint16, list string) []*net.IPNet {
+	trusted, err := backend.ParseCIDRs(list)
+	if err != nil {
+		logger.Errorf("[port %d] %s, ignored", port, err)
 	}
+	return trusted
 }
 
 func (c *Config) ConstructPool(pool Pool) *backend.Pool {
@@ -14,7 +14,9 @@ package config
 import (
 	"atlantis/router/backend"
 	"atlantis/router/routing"
+	"crypto/tls"
 	"testing"
+	"time"
 )
 
 func TestConstructServer(t *testing.T) {
@@ -22,11 +24,30 @@ func TestConstructServer(t *testing.T) {
 
 	server := config.ConstructServer(Host{
 		Address: "localhost:8080",
-	})
+	}, backend.PoolConfig{})
 
 	if server.Address != "localhost:8080" {
 		t.Errorf("should construct server accurately")
 	}
+	if server.Config.Weight != backend.DefaultWeight {
+		t.Errorf("should default host weight")
+	}
+
+	server = config.ConstructServer(Host{
+		Address: "localhost:8080",
+		Weight:  200,
+		Zone:    "us-east-1a",
+		Tags:    map[string]string{"size": "xlarge"},
+		MaxConn: 64,
+	}, backend.PoolConfig{MaxIdleConns: 8, DisableKeepAlives: true})
+
+	if server.Config.Weight != 200 || server.Config.Zone != "us-east-1a" ||
+		server.Config.Tags["size"] != "xlarge" || server.Config.MaxConn != 64 {
+		t.Errorf("should construct server config accurately")
+	}
+	if server.Transport.MaxIdleConnsPerHost != 8 || !server.Transport.DisableKeepAlives {
+		t.Errorf("should construct transport from pool config")
+	}
 }
 
 func TestConstructPoolConfig(t *testing.T) {
@@ -48,6 +69,201 @@ func TestConstructPoolConfig(t *testing.T) {
 		!backend.IsValidStatus(parsed.Status) {
 		t.Errorf("should default to sane defaults")
 	}
+	if parsed.Balancer != backend.BalanceLeastConn {
+		t.Errorf("should default to least cost balancer")
+	}
+	if parsed.HealthzMode != backend.HealthzHTTP {
+		t.Errorf("should default to http health checks")
+	}
+	if parsed.SlowStart != backend.Tstartup*time.Second || parsed.SlowStartCurve != backend.SlowStartHyperbolic {
+		t.Errorf("should default to hyperbolic slow start")
+	}
+
+	test.Config.SlowStart, test.Config.SlowStartCurve = "0s", "linear"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.SlowStartCurve != backend.SlowStartNone {
+		t.Errorf("should disable slow start without duration")
+	}
+
+	test.Config.SlowStart, test.Config.SlowStartCurve = "5m", "cubic"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.SlowStart != 5*time.Minute || parsed.SlowStartCurve != backend.SlowStartHyperbolic {
+		t.Errorf("should default invalid slow start curve")
+	}
+
+	test.Config.HealthzMode, test.Config.HealthzPath, test.Config.HealthzExpect = "udp", "healthz", "2xx"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.HealthzMode != backend.HealthzHTTP || parsed.HealthzPath != backend.DefaultHealthzPath ||
+		parsed.HealthzExpect != "" {
+		t.Errorf("should default invalid health check")
+	}
+
+	test.Config.HealthzMode, test.Config.HealthzService, test.Config.HTTP2 = "grpc", "echo.Echo", true
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.HealthzMode != backend.HealthzGRPC || parsed.HealthzService != "echo.Echo" || !parsed.HTTP2 {
+		t.Errorf("should accept grpc health check")
+	}
+	test.Config.HealthzMode = ""
+
+	test.Config.HealthzRise, test.Config.HealthzFall, test.Config.HealthzJitter = -1, 3, 101
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.HealthzRise != backend.DefaultHealthzRise || parsed.HealthzFall != 3 || parsed.HealthzJitter != 0 {
+		t.Errorf("should default invalid rise, fall and jitter")
+	}
+
+	test.Config.Balancer = "Roundrobin"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.Balancer != "Roundrobin" {
+		t.Errorf("should accept valid balancer")
+	}
+
+	test.Config.Balancer, test.Config.HashKey = "hash", "header:X-User"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.Balancer != "hash" || parsed.HashKey != "header:X-User" {
+		t.Errorf("should accept hash balancer with valid key")
+	}
+
+	test.Config.HashKey = "Uranus"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.Balancer != backend.BalanceLeastConn {
+		t.Errorf("should default hash balancer with invalid key to least cost")
+	}
+
+	test.Config.MaxConn, test.Config.ServerMaxConn, test.Config.MaxQueueTime = -1, 10, "Neptune"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.MaxConn != 0 || parsed.ServerMaxConn != 10 || parsed.MaxQueueTime != backend.DefaultMaxQueueTime {
+		t.Errorf("should default invalid max conn and queue time")
+	}
+	if parsed.DrainTimeout != backend.DefaultDrainTimeout {
+		t.Errorf("should default drain timeout")
+	}
+
+	test.Config.MaxTunnels, test.Config.TunnelIdleTimeout = -1, "0s"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.MaxTunnels != 0 || parsed.TunnelIdleTimeout != backend.DefaultTunnelIdleTimeout {
+		t.Errorf("should default invalid tunnel limits")
+	}
+
+	test.Config.FlushInterval = "-1s"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.FlushInterval != -time.Second {
+		t.Errorf("should allow negative flush interval")
+	}
+	test.Config.FlushInterval = "often"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.FlushInterval != 0 {
+		t.Errorf("should default invalid flush interval")
+	}
+
+	test.Config.ConnectTimeout, test.Config.ResponseHeaderTimeout = "2s", "Mercury"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.ConnectTimeout != 2*time.Second || parsed.ResponseHeaderTimeout != 0 {
+		t.Errorf("should leave invalid optional timeouts off")
+	}
+
+	test.Config.TLS, test.Config.TLSVerify = true, "sometimes"
+	parsed = config.ConstructPoolConfig(test)
+	if !parsed.TLS || parsed.TLSVerify != backend.TLSVerifyFull {
+		t.Errorf("should default invalid tls verification to full")
+	}
+
+	test.Config.ProxyProtocol = "v3"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.ProxyProtocol != "" {
+		t.Errorf("should not send invalid proxy protocol")
+	}
+	test.Config.ProxyProtocol = "V2"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.ProxyProtocol != backend.ProxyProtocolV2 {
+		t.Errorf("should accept proxy protocol v2")
+	}
+
+	test.Config.MaxAttempts, test.Config.RetryOn, test.Config.RetryBudget = -1, "sometimes", 200
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.MaxAttempts != 0 || parsed.RetryOn != backend.DefaultRetryOn ||
+		parsed.RetryBudget != backend.DefaultRetryBudget {
+		t.Errorf("should default invalid retry policy")
+	}
+
+	test.Config.BreakerErrorRate, test.Config.BreakerWindow, test.Config.BreakerOpenTime = 150, "Venus", "-1s"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.BreakerErrorRate != 0 || parsed.BreakerWindow != backend.DefaultBreakerWindow ||
+		parsed.BreakerOpenTime != backend.DefaultBreakerOpenTime {
+		t.Errorf("should disable breaker with invalid config")
+	}
+
+	test.Config.Balancer = "Pluto"
+	parsed = config.ConstructPoolConfig(test)
+	if parsed.Balancer != backend.BalanceLeastConn {
+		t.Errorf("should default invalid balancer to least cost")
+	}
+}
+
+func TestConstructTLSConfig(t *testing.T) {
+	config := NewConfig(routing.DefaultMatcherFactory())
+
+	parsed := config.ConstructTLSConfig(Port{Port: 443, TLS: true, TLSMinVersion: "2.0", TLSCiphers: "Saturn"}, nil)
+	if parsed.MinVersion != tls.VersionTLS12 || parsed.CipherSuites != nil {
+		t.Errorf("should default invalid tls policy")
+	}
+	if len(parsed.NextProtos) != 1 || parsed.NextProtos[0] != "http/1.1" {
+		t.Errorf("should only offer HTTP/1.1 by default")
+	}
+
+	parsed = config.ConstructTLSConfig(Port{
+		Port:          443,
+		TLS:           true,
+		TLSMinVersion: "1.3",
+		TLSCiphers:    "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		HTTP2:         true,
+	}, nil)
+	if parsed.MinVersion != tls.VersionTLS13 || len(parsed.CipherSuites) != 1 || parsed.NextProtos[0] != "h2" {
+		t.Errorf("should accept valid tls policy")
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "www.example.com"}
+	if _, err := parsed.GetCertificate(hello); err == nil {
+		t.Errorf("should fail handshake without certificate")
+	}
+	certPEM, keyPEM := testCertPEM(t, "www.example.com")
+	config.AddCert(Cert{Name: "www", Cert: string(certPEM), Key: string(keyPEM)})
+	if cert, err := parsed.GetCertificate(hello); err != nil || cert != config.Certs.Get("www.example.com") {
+		t.Errorf("should pick up certificates added later")
+	}
+}
+
+func TestConstructProxyTrusted(t *testing.T) {
+	config := NewConfig(routing.DefaultMatcherFactory())
+
+	if trusted := config.ConstructProxyTrusted(Port{Port: 80, ProxyProtocol: true}); trusted != nil {
+		t.Errorf("should trust no load balancers by default")
+	}
+	trusted := config.ConstructProxyTrusted(Port{Port: 80, ProxyProtocol: true, ProxyTrusted: "Mars"})
+	if trusted == nil || len(trusted) != 0 {
+		t.Errorf("should trust none with invalid entries only")
+	}
+	trusted = config.ConstructProxyTrusted(Port{Port: 80, ProxyProtocol: true, ProxyTrusted: "10.0.0.0/8,Mars"})
+	if len(trusted) != 1 || trusted[0].String() != "10.0.0.0/8" {
+		t.Errorf("should leave out invalid entries")
+	}
+	trusted = config.ConstructForwardedTrusted(Port{Port: 80, ForwardedTrusted: "2001:db8::/32"})
+	if len(trusted) != 1 || trusted[0].String() != "2001:db8::/32" {
+		t.Errorf("should trust forwarding proxies")
+	}
+}
+
+func TestConstructTraceSampleRate(t *testing.T) {
+	config := NewConfig(routing.DefaultMatcherFactory())
+
+	if rate := config.ConstructTraceSampleRate(Port{Port: 80}); rate != 0 {
+		t.Errorf("should sample no new traces by default")
+	}
+	if rate := config.ConstructTraceSampleRate(Port{Port: 80, TraceSampleRate: 0.25}); rate != 0.25 {
+		t.Errorf("should sample at configured rate")
+	}
+	if rate := config.ConstructTraceSampleRate(Port{Port: 80, TraceSampleRate: 1.5}); rate != 0 {
+		t.Errorf("should sample no new traces with invalid rate")
+	}
 }
 
 func TestConstructRuleEmpty(t *testing.T) {
@@ -20,11 +20,100 @@ type PoolConfig struct {
 	HealthzTimeout string
 	RequestTimeout string
 	Status         string
+	SlowStart      string
+	SlowStartCurve string
+	Balancer       string
+	HashKey        string
+	StickyCookie   string
+	// Requests in flight before queueing, per pool and per server unless the
+	// host has its own limit
+	MaxConn       int
+	ServerMaxConn int
+	MaxQueueTime  string
+	// Time removed hosts get to complete requests in flight
+	DrainTimeout string
+	// Upgraded connections tunneled at once, unlimited if zero
+	MaxTunnels        int
+	TunnelIdleTimeout string
+	// Flushing of responses, after every write if negative
+	FlushInterval string
+	// Tuning of server transports, see backend.NewTransport()
+	ConnectTimeout        string
+	KeepAlive             string
+	MaxIdleConns          int
+	IdleConnTimeout       string
+	ResponseHeaderTimeout string
+	DisableKeepAlives     bool
+	HTTP2                 bool
+	// PROXY protocol version sent to hosts, v1 or v2, none if empty
+	ProxyProtocol string
+	// TLS to hosts, with client certificates for mutual TLS
+	TLS           bool
+	TLSCAFile     string
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSServerName string
+	TLSVerify     string
+	// Probing of servers, see backend.HealthCheck
+	HealthzMode   string
+	HealthzPath   string
+	HealthzMethod string
+	HealthzHost   string
+	HealthzExpect string
+	HealthzBody   string
+	HealthzRise   int
+	HealthzFall   int
+	HealthzJitter int
+	// Service asked about by gRPC checks
+	HealthzService string
+	// Retries of failed requests on other servers
+	MaxAttempts        int
+	RetryOn            string
+	RetryNonIdempotent bool
+	RetryBudget        int
+	// Ejection of servers failing real traffic
+	OutlierConsecutive5xx     int
+	OutlierConsecutiveErrors  int
+	OutlierLatencyFactor      float64
+	OutlierEjectionTime       string
+	OutlierMaxEjectionPercent int
+	// Failing fast while the pool, or each server, errs too much
+	BreakerErrorRate   int
+	BreakerMinRequests int
+	BreakerWindow      string
+	BreakerOpenTime    string
+	BreakerServers     bool
 }
 
 func (p PoolConfig) Equals(o PoolConfig) bool {
 	return p.HealthzEvery == o.HealthzEvery && p.HealthzTimeout == o.HealthzTimeout &&
-		p.RequestTimeout == o.RequestTimeout && p.Status == o.Status
+		p.RequestTimeout == o.RequestTimeout && p.Status == o.Status &&
+		p.SlowStart == o.SlowStart && p.SlowStartCurve == o.SlowStartCurve &&
+		p.HealthzMode == o.HealthzMode && p.HealthzPath == o.HealthzPath &&
+		p.HealthzMethod == o.HealthzMethod && p.HealthzHost == o.HealthzHost &&
+		p.HealthzExpect == o.HealthzExpect && p.HealthzBody == o.HealthzBody &&
+		p.HealthzRise == o.HealthzRise && p.HealthzFall == o.HealthzFall && p.HealthzJitter == o.HealthzJitter &&
+		p.HealthzService == o.HealthzService &&
+		p.Balancer == o.Balancer && p.HashKey == o.HashKey && p.StickyCookie == o.StickyCookie &&
+		p.MaxConn == o.MaxConn && p.ServerMaxConn == o.ServerMaxConn && p.MaxQueueTime == o.MaxQueueTime &&
+		p.DrainTimeout == o.DrainTimeout &&
+		p.MaxTunnels == o.MaxTunnels && p.TunnelIdleTimeout == o.TunnelIdleTimeout &&
+		p.FlushInterval == o.FlushInterval &&
+		p.ConnectTimeout == o.ConnectTimeout && p.KeepAlive == o.KeepAlive && p.MaxIdleConns == o.MaxIdleConns &&
+		p.IdleConnTimeout == o.IdleConnTimeout && p.ResponseHeaderTimeout == o.ResponseHeaderTimeout &&
+		p.DisableKeepAlives == o.DisableKeepAlives && p.HTTP2 == o.HTTP2 &&
+		p.ProxyProtocol == o.ProxyProtocol &&
+		p.TLS == o.TLS && p.TLSCAFile == o.TLSCAFile && p.TLSCertFile == o.TLSCertFile &&
+		p.TLSKeyFile == o.TLSKeyFile && p.TLSServerName == o.TLSServerName && p.TLSVerify == o.TLSVerify &&
+		p.MaxAttempts == o.MaxAttempts && p.RetryOn == o.RetryOn &&
+		p.RetryNonIdempotent == o.RetryNonIdempotent && p.RetryBudget == o.RetryBudget &&
+		p.OutlierConsecutive5xx == o.OutlierConsecutive5xx &&
+		p.OutlierConsecutiveErrors == o.OutlierConsecutiveErrors &&
+		p.OutlierLatencyFactor == o.OutlierLatencyFactor && p.OutlierEjectionTime == o.OutlierEjectionTime &&
+		p.OutlierMaxEjectionPercent == o.OutlierMaxEjectionPercent &&
+		p.BreakerErrorRate == o.BreakerErrorRate && p.BreakerMinRequests == o.BreakerMinRequests &&
+		p.BreakerWindow == o.BreakerWindow && p.BreakerOpenTime == o.BreakerOpenTime &&
+		p.BreakerServers == o.BreakerServers
 }
 
 func (p PoolConfig) StringIndent(i string) (str string) {
@@ -33,6 +122,56 @@ func (p PoolConfig) StringIndent(i string) (str string) {
 	str += fmt.Sprintf("%s  Healthz Timeout : %s\n", i, p.HealthzTimeout)
 	str += fmt.Sprintf("%s  Request Timeout : %s\n", i, p.RequestTimeout)
 	str += fmt.Sprintf("%s  Status          : %s\n", i, p.Status)
+	str += fmt.Sprintf("%s  Slow Start      : %s\n", i, p.SlowStart)
+	str += fmt.Sprintf("%s  Slow Start Curve: %s\n", i, p.SlowStartCurve)
+	str += fmt.Sprintf("%s  Healthz Mode    : %s\n", i, p.HealthzMode)
+	str += fmt.Sprintf("%s  Healthz Path    : %s\n", i, p.HealthzPath)
+	str += fmt.Sprintf("%s  Healthz Method  : %s\n", i, p.HealthzMethod)
+	str += fmt.Sprintf("%s  Healthz Host    : %s\n", i, p.HealthzHost)
+	str += fmt.Sprintf("%s  Healthz Expect  : %s\n", i, p.HealthzExpect)
+	str += fmt.Sprintf("%s  Healthz Body    : %s\n", i, p.HealthzBody)
+	str += fmt.Sprintf("%s  Healthz Rise    : %d\n", i, p.HealthzRise)
+	str += fmt.Sprintf("%s  Healthz Fall    : %d\n", i, p.HealthzFall)
+	str += fmt.Sprintf("%s  Healthz Jitter  : %d%%\n", i, p.HealthzJitter)
+	str += fmt.Sprintf("%s  Healthz Service : %s\n", i, p.HealthzService)
+	str += fmt.Sprintf("%s  Balancer        : %s\n", i, p.Balancer)
+	str += fmt.Sprintf("%s  Hash Key        : %s\n", i, p.HashKey)
+	str += fmt.Sprintf("%s  Sticky Cookie   : %s\n", i, p.StickyCookie)
+	str += fmt.Sprintf("%s  Max Conn        : %d\n", i, p.MaxConn)
+	str += fmt.Sprintf("%s  Server Max Conn : %d\n", i, p.ServerMaxConn)
+	str += fmt.Sprintf("%s  Max Queue Time  : %s\n", i, p.MaxQueueTime)
+	str += fmt.Sprintf("%s  Drain Timeout   : %s\n", i, p.DrainTimeout)
+	str += fmt.Sprintf("%s  Max Tunnels     : %d\n", i, p.MaxTunnels)
+	str += fmt.Sprintf("%s  Tunnel Idle     : %s\n", i, p.TunnelIdleTimeout)
+	str += fmt.Sprintf("%s  Flush Interval  : %s\n", i, p.FlushInterval)
+	str += fmt.Sprintf("%s  Connect Timeout : %s\n", i, p.ConnectTimeout)
+	str += fmt.Sprintf("%s  Keep Alive      : %s\n", i, p.KeepAlive)
+	str += fmt.Sprintf("%s  Max Idle Conns  : %d\n", i, p.MaxIdleConns)
+	str += fmt.Sprintf("%s  Idle Timeout    : %s\n", i, p.IdleConnTimeout)
+	str += fmt.Sprintf("%s  Header Timeout  : %s\n", i, p.ResponseHeaderTimeout)
+	str += fmt.Sprintf("%s  No Keep Alives  : %t\n", i, p.DisableKeepAlives)
+	str += fmt.Sprintf("%s  HTTP/2          : %t\n", i, p.HTTP2)
+	str += fmt.Sprintf("%s  PROXY Protocol  : %s\n", i, p.ProxyProtocol)
+	str += fmt.Sprintf("%s  TLS             : %t\n", i, p.TLS)
+	str += fmt.Sprintf("%s  TLS CA File     : %s\n", i, p.TLSCAFile)
+	str += fmt.Sprintf("%s  TLS Cert File   : %s\n", i, p.TLSCertFile)
+	str += fmt.Sprintf("%s  TLS Key File    : %s\n", i, p.TLSKeyFile)
+	str += fmt.Sprintf("%s  TLS Server Name : %s\n", i, p.TLSServerName)
+	str += fmt.Sprintf("%s  TLS Verify      : %s\n", i, p.TLSVerify)
+	str += fmt.Sprintf("%s  Max Attempts    : %d\n", i, p.MaxAttempts)
+	str += fmt.Sprintf("%s  Retry On        : %s\n", i, p.RetryOn)
+	str += fmt.Sprintf("%s  Retry Non-Idem. : %t\n", i, p.RetryNonIdempotent)
+	str += fmt.Sprintf("%s  Retry Budget    : %d%%\n", i, p.RetryBudget)
+	str += fmt.Sprintf("%s  Outlier 5xx     : %d\n", i, p.OutlierConsecutive5xx)
+	str += fmt.Sprintf("%s  Outlier Errors  : %d\n", i, p.OutlierConsecutiveErrors)
+	str += fmt.Sprintf("%s  Outlier Latency : %g\n", i, p.OutlierLatencyFactor)
+	str += fmt.Sprintf("%s  Ejection Time   : %s\n", i, p.OutlierEjectionTime)
+	str += fmt.Sprintf("%s  Max Ejection    : %d%%\n", i, p.OutlierMaxEjectionPercent)
+	str += fmt.Sprintf("%s  Breaker Errors  : %d%%\n", i, p.BreakerErrorRate)
+	str += fmt.Sprintf("%s  Breaker Min Req : %d\n", i, p.BreakerMinRequests)
+	str += fmt.Sprintf("%s  Breaker Window  : %s\n", i, p.BreakerWindow)
+	str += fmt.Sprintf("%s  Breaker Open    : %s\n", i, p.BreakerOpenTime)
+	str += fmt.Sprintf("%s  Breaker Servers : %t\n", i, p.BreakerServers)
 	return
 }
 
@@ -42,15 +181,35 @@ func (p PoolConfig) String() string {
 
 type Host struct {
 	Address string
+	Weight  uint32
+	Zone    string
+	Tags    map[string]string
+	MaxConn int
 }
 
 func (h Host) Equals(o Host) bool {
-	return h.Address == o.Address
+	if h.Address != o.Address || h.Weight != o.Weight || h.Zone != o.Zone || h.MaxConn != o.MaxConn ||
+		len(h.Tags) != len(o.Tags) {
+		return false
+	}
+	for key, val := range h.Tags {
+		if oval, ok := o.Tags[key]; !ok || oval != val {
+			return false
+		}
+	}
+	return true
 }
 
 func (h Host) StringIndent(i string) (str string) {
 	str += fmt.Sprintf("%s--Host\n", i)
 	str += fmt.Sprintf("%s  Address : %s\n", i, h.Address)
+	str += fmt.Sprintf("%s  Weight  : %d\n", i, h.Weight)
+	str += fmt.Sprintf("%s  Zone    : %s\n", i, h.Zone)
+	str += fmt.Sprintf("%s  MaxConn : %d\n", i, h.MaxConn)
+	str += fmt.Sprintf("%s  --Tags\n", i)
+	for key, val := range h.Tags {
+		str += fmt.Sprintf("%s    %s : %s\n", i, key, val)
+	}
 	return
 }
 
@@ -142,6 +301,28 @@ type Port struct {
 	Port     uint16
 	Trie     string
 	Internal bool
+	// HTTPS with certificates from CertDir and then the certs subtree,
+	// picked by SNI hostname
+	TLS           bool
+	CertDir       string
+	TLSMinVersion string
+	TLSCiphers    string
+	// HTTP/2 negotiated on HTTPS ports, and with prior knowledge on HTTP
+	// ports if H2C
+	HTTP2 bool
+	H2C   bool
+	// Client addresses from PROXY protocol headers, which load balancers in
+	// ProxyTrusted must send and no one else may, none if it is empty
+	ProxyProtocol bool
+	ProxyTrusted  string
+	// Clients whose X-Forwarded-* and Forwarded headers are kept rather
+	// than dropped, none if empty, and whose X-Request-Id is reused
+	// rather than replaced if TrustRequestID
+	ForwardedTrusted string
+	TrustRequestID   bool
+	// Share of requests starting a trace which are sampled, 0 to 1;
+	// requests continuing one follow its sampling decision
+	TraceSampleRate float64
 }
 
 func (p Port) Equals(o Port) bool {
@@ -153,9 +334,48 @@ func (p Port) StringIndent(i string) (str string) {
 	str += fmt.Sprintf("%s  Internal : %t\n", i, p.Internal)
 	str += fmt.Sprintf("%s  Port     : %d\n", i, p.Port)
 	str += fmt.Sprintf("%s  Trie     : %s\n", i, p.Trie)
+	str += fmt.Sprintf("%s  TLS      : %t\n", i, p.TLS)
+	if p.TLS {
+		str += fmt.Sprintf("%s  CertDir       : %s\n", i, p.CertDir)
+		str += fmt.Sprintf("%s  TLSMinVersion : %s\n", i, p.TLSMinVersion)
+		str += fmt.Sprintf("%s  TLSCiphers    : %s\n", i, p.TLSCiphers)
+	}
+	str += fmt.Sprintf("%s  HTTP2    : %t\n", i, p.HTTP2)
+	str += fmt.Sprintf("%s  H2C      : %t\n", i, p.H2C)
+	str += fmt.Sprintf("%s  PROXY    : %t\n", i, p.ProxyProtocol)
+	if p.ProxyProtocol {
+		str += fmt.Sprintf("%s  ProxyTrusted  : %s\n", i, p.ProxyTrusted)
+	}
+	if p.ForwardedTrusted != "" {
+		str += fmt.Sprintf("%s  ForwardedTrusted : %s\n", i, p.ForwardedTrusted)
+	}
+	str += fmt.Sprintf("%s  TrustRequestID : %t\n", i, p.TrustRequestID)
+	str += fmt.Sprintf("%s  TraceSampleRate : %g\n", i, p.TraceSampleRate)
 	return
 }
 
 func (p *Port) String() string {
 	return p.StringIndent("")
 }
+
+// PEM encoded certificate chain and private key for HTTPS ports.
+type Cert struct {
+	Name string
+	Cert string
+	Key  string
+}
+
+// Rotated certificates keep their name, so the PEM contents are compared too.
+func (c Cert) Equals(o Cert) bool {
+	return c.Name == o.Name && c.Cert == o.Cert && c.Key == o.Key
+}
+
+func (c Cert) StringIndent(i string) (str string) {
+	str += fmt.Sprintf("%s--Cert\n", i)
+	str += fmt.Sprintf("%s  Name : %s\n", i, c.Name)
+	return
+}
+
+func (c Cert) String() string {
+	return c.StringIndent("")
+}
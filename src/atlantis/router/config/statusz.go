@@ -12,6 +12,7 @@
 package config
 
 import (
+	"atlantis/router/backend"
 	"atlantis/router/logger"
 	"encoding/json"
 	"fmt"
@@ -22,10 +23,36 @@ import (
 type StatusZ struct {
 	Pool             string `json:"pool"`
 	Server           string `json:"server"`
+	Weight           uint32 `json:"weight"`
+	Zone             string `json:"zone"`
 	RequestsInFlight uint32 `json:"requests_in_flight"`
 	RequestsServiced uint64 `json:"requests_serviced"`
+	GRPCErrors       uint64 `json:"grpc_errors"`
 	Status           string `json:"status"`
 	StatusChanged    string `json:"status_changed"`
+	SlowStartFactor  uint32 `json:"slow_start_factor"`
+	Ejected          bool   `json:"ejected"`
+	Breaker          string `json:"breaker"`
+	PoolBreaker      string `json:"pool_breaker"`
+	Draining         bool   `json:"draining"`
+}
+
+func NewStatusZ(pool *backend.Pool, server *backend.Server) StatusZ {
+	return StatusZ{
+		Pool:             pool.Name,
+		Server:           server.Address,
+		Weight:           server.Config.Weight,
+		Zone:             server.Config.Zone,
+		RequestsInFlight: server.Metrics.RequestsInFlight,
+		RequestsServiced: server.Metrics.RequestsServiced,
+		GRPCErrors:       server.Metrics.GRPCErrors,
+		Status:           server.Status.Current,
+		StatusChanged:    fmt.Sprintf("%s", server.Status.Changed),
+		SlowStartFactor:  server.Status.SlowStartFactor(),
+		Ejected:          server.Outlier.Ejected(),
+		Breaker:          server.Breaker.State(),
+		PoolBreaker:      pool.BreakerState(),
+	}
 }
 
 func (c *Config) StatusZJSON() (string, error) {
@@ -33,15 +60,12 @@ func (c *Config) StatusZJSON() (string, error) {
 
 	c.RLock()
 	for _, pool := range c.Pools {
-		for _, server := range pool.Servers {
-			s := StatusZ{
-				Pool:             pool.Name,
-				Server:           server.Address,
-				RequestsInFlight: server.Metrics.RequestsInFlight,
-				RequestsServiced: server.Metrics.RequestsServiced,
-				Status:           server.Status.Current,
-				StatusChanged:    fmt.Sprintf("%s", server.Status.Changed),
-			}
+		for _, server := range pool.ServerList() {
+			response = append(response, NewStatusZ(pool, server))
+		}
+		for _, server := range pool.Draining() {
+			s := NewStatusZ(pool, server)
+			s.Draining = true
 			response = append(response, s)
 		}
 	}
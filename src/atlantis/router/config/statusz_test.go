@@ -0,0 +1,56 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package config
+
+import (
+	"atlantis/router/backend"
+	"atlantis/router/routing"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestStatusZJSON(t *testing.T) {
+	config := NewConfig(routing.DefaultMatcherFactory())
+	config.AddPool(bakeryPool())
+	defer config.DelPool("bakeryPool")
+	pool := config.Pools["bakeryPool"]
+	pool.AddServer("host0", backend.NewServer("localhost:8083"))
+
+	// servers come and go while status is served
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("host%d", i%3+1)
+			pool.UpdateServer(name, backend.NewServer(fmt.Sprintf("localhost:%d", 9000+i)))
+			pool.DelServer(name)
+		}
+	}()
+	for serving := true; serving; {
+		select {
+		case <-done:
+			serving = false
+		default:
+		}
+		if _, err := config.StatusZJSON(); err != nil {
+			t.Fatalf("should serialize status: %s", err)
+		}
+	}
+
+	data, _ := config.StatusZJSON()
+	var status []StatusZ
+	json.Unmarshal([]byte(data), &status)
+	if len(status) == 0 || status[0].Pool != "bakeryPool" || status[0].Server != "localhost:8083" {
+		t.Errorf("should report servers of pools, got %s", data)
+	}
+}
@@ -7,11 +7,15 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	HAProxyFmtStr         = "haproxy[%d]: %s:%s [%s] %s %s/%s %d/%d/%d/%d/%d %d %d %s %s %s %d/%d/%d/%d/%d %d/%d {%s} {%s} \"%s\"\n"
+	// HAProxy's HTTP log format followed by the client and server protocols
+	// and the request ID, see the README
+	HAProxyFmtStr         = "haproxy[%d]: %s:%s [%s] %s %s/%s %d/%d/%d/%d/%d %d %d %s %s %s %d/%d/%d/%d/%d %d/%d {%s} {%s} \"%s\" %s %s %s\n"
+	BadRequestMsg         = "Bad Request"
 	BadGatewayMsg         = "Bad Gateway"
 	GatewayTimeoutMsg     = "Gateway Timeout"
 	ServiceUnavailableMsg = "Service Unavailable"
@@ -43,6 +47,9 @@ type HAProxyLogRecord struct {
 	capturedRequestHeaders                    string
 	capturedResponseHeaders                   string
 	httpRequest                               string
+	proto, serverProto                        string
+	requestID                                 string
+	trailer                                   http.Header
 	sLog                                      *log.Logger
 }
 
@@ -55,10 +62,19 @@ func NewShallowHAProxyLogRecord(out io.Writer, w http.ResponseWriter, r *http.Re
 	return &HAProxyLogRecord{
 		ResponseWriter: w,
 		Request:        r,
+		acceptDate:     time.Now(),
+		proto:          r.Proto,
+		serverProto:    "-",
+		requestID:      "-",
 		sLog:           tlog,
 	}
 }
 
+// SetLogger sends the log line elsewhere, for tests to look at.
+func (r *HAProxyLogRecord) SetLogger(l *log.Logger) {
+	r.sLog = l
+}
+
 func NewHAProxyLogRecord(w http.ResponseWriter, r *http.Request, frontendPort string, feConn uint32, acceptDate time.Time) HAProxyLogRecord {
 	var headStr, fullReq string
 	for key, value := range r.Header {
@@ -88,6 +104,9 @@ func NewHAProxyLogRecord(w http.ResponseWriter, r *http.Request, frontendPort st
 		feConn:                 feConn,
 		capturedRequestHeaders: headStr,
 		httpRequest:            fullReq,
+		proto:                  r.Proto,
+		serverProto:            "-",
+		requestID:              "-",
 		actConn:                0,
 		tq:                     0,
 		tw:                     0,
@@ -129,7 +148,7 @@ func (r *HAProxyLogRecord) Log() {
 		r.tq, r.tw, r.tc, r.tr, r.tt, r.statusCode, r.bytesRead, r.capturedReqCookie,
 		r.capturedResCookie, r.terminationState, r.actConn, r.feConn, r.beConn,
 		r.srvConn, r.retries, r.srvQueue, r.backendQueue, r.capturedRequestHeaders,
-		resHeadStr, r.httpRequest)
+		resHeadStr, r.httpRequest, r.proto, r.serverProto, r.requestID)
 }
 
 func getCookiesString(cookies []*http.Cookie) string {
@@ -163,13 +182,40 @@ func (r *HAProxyLogRecord) ServerUpdateRecord(name string, sQueue uint64, sConn
 	r.srvConn = sConn
 	r.enterServerTime = sTime
 }
+func (r *HAProxyLogRecord) SetServerProto(proto string) {
+	r.serverProto = proto
+}
+func (r *HAProxyLogRecord) ServerProto() string {
+	return r.serverProto
+}
+func (r *HAProxyLogRecord) Retry() {
+	r.retries++
+}
+func (r *HAProxyLogRecord) Retries() uint32 {
+	return r.retries
+}
 func (r *HAProxyLogRecord) CopyHeaders(hdrs http.Header) {
 	for hdr, vals := range hdrs {
+		// ours is echoed, should the server have its own
+		if hdr == RequestIDHeader && r.requestID != "-" {
+			continue
+		}
 		for _, val := range vals {
 			r.AddResponseHeader(hdr, val)
 		}
 	}
 }
+func (r *HAProxyLogRecord) CopyTrailers(trailer http.Header) {
+	for hdr, vals := range trailer {
+		for _, val := range vals {
+			r.AddResponseHeader(http.TrailerPrefix+hdr, val)
+		}
+	}
+	r.trailer = trailer
+}
+func (r *HAProxyLogRecord) GetResponseTrailers() http.Header {
+	return r.trailer
+}
 func (r *HAProxyLogRecord) AddResponseHeader(hdr, val string) {
 	r.bytesRead += int64(len(hdr))
 	r.bytesRead += int64(len(val))
@@ -181,6 +227,86 @@ func (r *HAProxyLogRecord) Copy(src io.Reader) (err error) {
 	return err
 
 }
+
+// Stream is Copy for streaming responses, flushing headers right away and
+// the body after every write if interval is negative, or at most interval
+// after it was written otherwise.
+func (r *HAProxyLogRecord) Stream(src io.Reader, interval time.Duration) (err error) {
+	flusher, ok := r.ResponseWriter.(http.Flusher)
+	if !ok {
+		return r.Copy(src)
+	}
+	flusher.Flush()
+	var dst io.Writer = flushWriter{r.ResponseWriter, flusher}
+	if interval > 0 {
+		latency := &latencyWriter{w: r.ResponseWriter, flusher: flusher, interval: interval}
+		defer latency.stop()
+		dst = latency
+	}
+	bwritten, err := copier.Copy(dst, src)
+	r.bytesRead += bwritten
+	return err
+}
+
+type flushWriter struct {
+	io.Writer
+	http.Flusher
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.Flush()
+	return n, err
+}
+
+// Flushes writes at most interval after they were made, batching those
+// in between.
+type latencyWriter struct {
+	sync.Mutex
+	w        io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+	timer    *time.Timer
+	pending  bool
+}
+
+func (w *latencyWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	n, err := w.w.Write(p)
+	if !w.pending {
+		w.pending = true
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.interval, w.flush)
+		} else {
+			w.timer.Reset(w.interval)
+		}
+	}
+	return n, err
+}
+
+func (w *latencyWriter) flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.pending {
+		w.flusher.Flush()
+		w.pending = false
+	}
+}
+
+// Must be called before the response is done, no flush may come after.
+func (w *latencyWriter) stop() {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.pending = false
+}
+
 func (r *HAProxyLogRecord) WriteHeader(code int) {
 	if code >= 100 && code <= 599 {
 		r.statusCode = code
@@ -188,6 +314,11 @@ func (r *HAProxyLogRecord) WriteHeader(code int) {
 	}
 
 }
+func (r *HAProxyLogRecord) Tunneled(code int, bytes int64) {
+	r.statusCode = code
+	r.bytesRead += bytes
+	r.serverResTime = time.Now()
+}
 func (r *HAProxyLogRecord) GetResponseStatusCode() int {
 	//if status code has not been set
 	if r.statusCode < 100 || r.statusCode > 599 {
@@ -213,6 +344,15 @@ func (r *HAProxyLogRecord) UpdateTr(resStartTime, resRetTime time.Time) {
 
 //Set's the termination state and log's the request
 func (r *HAProxyLogRecord) Terminate(termState string) {
+	// requests terminated in a queue, or before the server answered, waited
+	// until now
+	now := time.Now()
+	if r.enterServerTime.IsZero() && !r.enterPoolTime.IsZero() {
+		r.enterServerTime = now
+	}
+	if r.serverResTime.IsZero() {
+		r.serverResTime = now
+	}
 	r.terminationState = termState
 	r.Log()
 }
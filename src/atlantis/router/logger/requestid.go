@@ -0,0 +1,70 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package logger
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+const (
+	RequestIDHeader = "X-Request-Id"
+	// Longest incoming ID reused, see IsValidRequestID()
+	MaxRequestIDLen = 128
+)
+
+// NewRequestID returns a random (version 4) UUID.
+func NewRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Incoming IDs end up in logs, so only short printable ones are reused.
+func IsValidRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetRequestID tags the request with id, to be echoed in the response and
+// logged along with everything about the request.
+func (r *HAProxyLogRecord) SetRequestID(id string) {
+	r.requestID = id
+	r.ResponseWriter.Header().Set(RequestIDHeader, id)
+}
+
+func (r *HAProxyLogRecord) RequestID() string {
+	return r.requestID
+}
+
+// Errorf, Printf and Debugf log as the package functions do, tagged with the
+// request ID.
+func (r *HAProxyLogRecord) Errorf(format string, args ...interface{}) {
+	Errorf("[request %s] "+format, append([]interface{}{r.requestID}, args...)...)
+}
+
+func (r *HAProxyLogRecord) Printf(format string, args ...interface{}) {
+	Printf("[request %s] "+format, append([]interface{}{r.requestID}, args...)...)
+}
+
+func (r *HAProxyLogRecord) Debugf(format string, args ...interface{}) {
+	Debugf("[request %s] "+format, append([]interface{}{r.requestID}, args...)...)
+}
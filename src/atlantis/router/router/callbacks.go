@@ -68,7 +68,7 @@ func (h *HostCallbacks) Created(zkPath, jsonBlob string) {
 	}
 
 	if pool := h.config.Pools[poolName]; pool != nil {
-		pool.AddServer(hostName, h.config.ConstructServer(host))
+		pool.AddServer(hostName, h.config.ConstructServer(host, pool.Config))
 	}
 }
 
@@ -80,8 +80,19 @@ func (h *HostCallbacks) Deleted(zkPath string) {
 	}
 }
 
-func (h *HostCallbacks) Changed(path, jsonBlob string) {
-	logger.Errorf("HostCallbacks.Changed(%s, %s)", path, jsonBlob)
+func (h *HostCallbacks) Changed(zkPath, jsonBlob string) {
+	logger.Debugf("HostCallbacks.Changed(%s, %s)", zkPath, jsonBlob)
+	hostName, poolName := h.splitPath(zkPath)
+
+	var host config.Host
+	if err := json.Unmarshal([]byte(jsonBlob), &host); err != nil {
+		logger.Errorf("%s unmarshalling %s as host", err.Error(), jsonBlob)
+		return
+	}
+
+	if pool := h.config.Pools[poolName]; pool != nil {
+		pool.UpdateServer(hostName, h.config.ConstructServer(host, pool.Config))
+	}
 }
 
 type RuleCallbacks struct {
@@ -156,7 +167,7 @@ func (p *PortCallbacks) Created(zkPath, jsonBlob string) {
 		return
 	}
 	p.config.AddPort(port)
-	p.router.AddPort(port.Port)
+	p.router.AddPort(port)
 }
 
 func (p *PortCallbacks) Deleted(zkPath string) {
@@ -178,4 +189,37 @@ func (p *PortCallbacks) Changed(zkPath, jsonBlob string) {
 		return
 	}
 	p.config.UpdatePort(port)
+	p.router.UpdatePort(port)
+}
+
+type CertCallbacks struct {
+	config *config.Config
+}
+
+func (c *CertCallbacks) Created(zkPath, jsonBlob string) {
+	logger.Debugf("CertCallbacks.Created(%s)", zkPath)
+	var cert config.Cert
+	if err := json.Unmarshal([]byte(jsonBlob), &cert); err != nil {
+		logger.Errorf("%s unmarshalling %s as cert", err.Error(), zkPath)
+		return
+	}
+	// keyed by node name, as deletions only know that
+	cert.Name = path.Base(zkPath)
+	c.config.AddCert(cert)
+}
+
+func (c *CertCallbacks) Deleted(zkPath string) {
+	logger.Debugf("CertCallbacks.Deleted(%s)", zkPath)
+	c.config.DelCert(path.Base(zkPath))
+}
+
+func (c *CertCallbacks) Changed(zkPath, jsonBlob string) {
+	logger.Debugf("CertCallbacks.Changed(%s)", zkPath)
+	var cert config.Cert
+	if err := json.Unmarshal([]byte(jsonBlob), &cert); err != nil {
+		logger.Errorf("%s unmarshalling %s as cert", err.Error(), zkPath)
+		return
+	}
+	cert.Name = path.Base(zkPath)
+	c.config.UpdateCert(cert)
 }
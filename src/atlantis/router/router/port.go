@@ -16,9 +16,12 @@ import (
 	"atlantis/router/backend"
 	"atlantis/router/config"
 	"atlantis/router/logger"
+	"atlantis/router/tracing"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -27,32 +30,152 @@ type Port struct {
 	config   *config.Config
 	listener net.Listener
 	Metrics  backend.ConnectionMetrics
+	h2c      bool
+	// if the port takes PROXY protocol
+	proxy *backend.ProxyListener
+	// nil if tracing is off
+	tracer *tracing.Tracer
+
+	// swapped on reconfiguration while the listener stays up, the TLS
+	// policy of HTTPS ports only
+	sync.RWMutex
+	forwardedTrusted []*net.IPNet
+	trustRequestID   bool
+	traceSampleRate  float64
+	tls              *tls.Config
+	certs            *config.CertStore
+	certDir          string
 }
 
-func NewPort(p uint16, c *config.Config) (*Port, error) {
-	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", p))
+func NewPort(port config.Port, c *config.Config, tracer *tracing.Tracer) (*Port, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port.Port))
 	if err != nil {
 		return nil, err
 	}
-	return &Port{
-		port:     p,
+	p := &Port{
+		port:     port.Port,
 		config:   c,
 		listener: l,
 		Metrics:  backend.NewConnectionMetrics(),
-	}, nil
+		h2c:      port.H2C && !port.TLS,
+		tracer:   tracer,
+	}
+	if port.ProxyProtocol {
+		// the PROXY header comes before the TLS handshake
+		p.proxy = backend.NewProxyListener(l, c.ConstructProxyTrusted(port))
+		p.listener = p.proxy
+	}
+	if port.TLS {
+		p.certs = config.NewCertStore()
+		p.listener = tls.NewListener(p.listener, &tls.Config{GetConfigForClient: p.getTLSConfig})
+	}
+	p.Reconfigure(port)
+	return p, nil
+}
+
+func (p *Port) IsTLS() bool {
+	return p.certs != nil
+}
+
+// Reconfigure applies the trusted proxies, and the TLS policy and certificate
+// directory of an HTTPS port. Turning PROXY protocol or TLS on or off needs a
+// new Port.
+func (p *Port) Reconfigure(port config.Port) {
+	if p.proxy != nil {
+		p.proxy.SetTrusted(p.config.ConstructProxyTrusted(port))
+	}
+	p.Lock()
+	p.forwardedTrusted = p.config.ConstructForwardedTrusted(port)
+	p.trustRequestID = port.TrustRequestID
+	p.traceSampleRate = p.config.ConstructTraceSampleRate(port)
+	p.Unlock()
+
+	if !p.IsTLS() {
+		return
+	}
+
+	p.Lock()
+	p.certDir = port.CertDir
+	p.tls = p.config.ConstructTLSConfig(port, p.certs)
+	p.Unlock()
+
+	p.ReloadCerts()
+}
+
+// ReloadCerts picks up changes to the certificate directory. Certificates are
+// kept if the directory can't be read at all.
+func (p *Port) ReloadCerts() {
+	if !p.IsTLS() {
+		return
+	}
+
+	p.RLock()
+	dir := p.certDir
+	p.RUnlock()
+
+	if dir == "" {
+		p.certs.Replace(map[string]*tls.Certificate{})
+		return
+	}
+	certs, err := config.LoadCertDir(dir)
+	if err != nil {
+		logger.Errorf("[port %d] failed loading certificates: %s", p.port, err)
+		return
+	}
+	p.certs.Replace(certs)
+	logger.Printf("[port %d] loaded %d certificates from %s", p.port, len(certs), dir)
+}
+
+func (p *Port) getTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.tls, nil
 }
 
 func (p *Port) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	enterTime := time.Now()
 	p.Metrics.ConnectionStart()
+	p.RLock()
+	trusted := backend.IsTrustedClient(p.forwardedTrusted, r)
+	trustRequestID := p.trustRequestID
+	sampleRate := p.traceSampleRate
+	p.RUnlock()
+	span := p.tracer.StartRequest(r, r.Method, sampleRate)
+	if span != nil {
+		r = r.WithContext(tracing.NewContext(r.Context(), span))
+	}
 	logRecord := logger.NewHAProxyLogRecord(w, r, p.config.Ports[p.port].Name, p.Metrics.GetActiveConnections(), enterTime)
-	if pool := p.config.RoutePort(p.port, r); pool != nil {
+	if !trusted {
+		backend.StripForwarded(r.Header)
+	}
+	// sent on to the server as is
+	id := r.Header.Get(logger.RequestIDHeader)
+	if !trusted || !trustRequestID || !logger.IsValidRequestID(id) {
+		id = logger.NewRequestID()
+		r.Header.Set(logger.RequestIDHeader, id)
+	}
+	logRecord.SetRequestID(id)
+	span.SetAttribute("request.id", id)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("server.port", int(p.port))
+	span.SetAttribute("client.address", r.RemoteAddr)
+	routing := span.Child("route", tracing.SpanKindInternal)
+	pool := p.config.RoutePort(p.port, r)
+	routing.Finish()
+	if pool != nil {
+		span.SetAttribute("pool", pool.Name)
 		pool.Handle(&logRecord)
 	} else {
 		//http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		logRecord.Error(logger.BadGatewayMsg, http.StatusBadGateway)
 		logRecord.Terminate("Port: " + logger.BadGatewayMsg)
 	}
+	if span != nil {
+		span.SetStatus(logRecord.GetResponseStatusCode())
+	}
+	span.Finish()
 	p.Metrics.ConnectionDone()
 }
 
@@ -62,7 +185,14 @@ func (p *Port) Run(rout, wout time.Duration) {
 		ReadTimeout:    rout,
 		WriteTimeout:   wout,
 		MaxHeaderBytes: 1 << 20,
+		Protocols:      new(http.Protocols),
+		ConnContext:    backend.ConnContext,
 	}
+	server.Protocols.SetHTTP1(true)
+	// HTTPS ports speak HTTP/2 only when offered in ALPN, see
+	// config.ConstructTLSConfig
+	server.Protocols.SetHTTP2(p.IsTLS())
+	server.Protocols.SetUnencryptedHTTP2(p.h2c)
 	server.Serve(p.listener)
 }
 
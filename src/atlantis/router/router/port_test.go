@@ -0,0 +1,43 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+
+package router
+
+import (
+	"atlantis/router/backend"
+	"atlantis/router/config"
+	"atlantis/router/logger"
+	"atlantis/router/routing"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeHTTPForwarded(t *testing.T) {
+	c := config.NewConfig(routing.DefaultMatcherFactory())
+	c.AddPort(config.Port{Port: 80})
+	p := &Port{port: 80, config: c, Metrics: backend.NewConnectionMetrics()}
+	p.Reconfigure(config.Port{Port: 80})
+
+	req := httptest.NewRequest("GET", "http://test/", nil)
+	req.RemoteAddr = "192.0.2.1:56324"
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Forwarded", "for=10.0.0.1")
+	req.Header.Set(logger.RequestIDHeader, "Pluto")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	if req.Header.Get("X-Forwarded-For") != "" || req.Header.Get("Forwarded") != "" {
+		t.Errorf("should strip forwarding headers when no proxies are trusted")
+	}
+	if req.Header.Get(logger.RequestIDHeader) == "Pluto" {
+		t.Errorf("should replace request id of untrusted clients")
+	}
+}
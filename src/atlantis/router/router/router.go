@@ -15,7 +15,12 @@ import (
 	"atlantis/router/config"
 	"atlantis/router/logger"
 	"atlantis/router/routing"
+	"atlantis/router/tracing"
 	"atlantis/router/zk"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -25,6 +30,7 @@ type Router struct {
 	ZkRoot string
 
 	// ports to listen
+	portsLock  sync.Mutex
 	ports      map[uint16]*Port
 	statusPort uint16
 
@@ -35,20 +41,29 @@ type Router struct {
 	ruleCallbacks zk.EventCallbacks
 	trieCallbacks zk.EventCallbacks
 	portCallbacks zk.EventCallbacks
+	certCallbacks zk.EventCallbacks
 
 	// configuration
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// spans of requests are exported through this, nil to turn tracing off
+	Tracer *tracing.Tracer
 }
 
 func New(zkServers string, statusPort uint16) *Router {
+	return NewAuth(zkServers, "", statusPort)
+}
+
+// NewAuth is New authenticating to zookeeper as zkAuth, see
+// zk.ManagedZkConnAuth.
+func NewAuth(zkServers, zkAuth string, statusPort uint16) *Router {
 	// all packages use atlantis/logger's global logger
 	logger.InitPkgLogger()
 
 	c := config.NewConfig(routing.DefaultMatcherFactory())
 	r := &Router{
 		ZkRoot: "/atlantis/router",
-		zk:     zk.ManagedZkConn(zkServers),
+		zk:     zk.ManagedZkConnAuth(zkServers, zkAuth),
 
 		ports:      map[uint16]*Port{},
 		statusPort: statusPort,
@@ -58,6 +73,7 @@ func New(zkServers string, statusPort uint16) *Router {
 		hostCallbacks: &HostCallbacks{config: c},
 		ruleCallbacks: &RuleCallbacks{config: c},
 		trieCallbacks: &TrieCallbacks{config: c},
+		certCallbacks: &CertCallbacks{config: c},
 
 		ReadTimeout:  120 * time.Second,
 		WriteTimeout: 120 * time.Second,
@@ -72,6 +88,7 @@ func New(zkServers string, statusPort uint16) *Router {
 func (r *Router) Run() {
 	// configuration manager
 	go r.reconfigure()
+	go r.reloadOnHangup()
 
 	// launch the statusz and debug server
 	NewStatusServer(r).Run(r.statusPort, 8*time.Second)
@@ -86,21 +103,73 @@ func (r *Router) reconfigure() {
 		go r.zk.ManageTree(zk.ZkPaths["rules"], r.ruleCallbacks)
 		go r.zk.ManageTree(zk.ZkPaths["tries"], r.trieCallbacks)
 		go r.zk.ManageTree(zk.ZkPaths["ports"], r.portCallbacks)
+		go r.zk.ManageTree(zk.ZkPaths["certs"], r.certCallbacks)
+	}
+}
+
+// Certificate directories of HTTPS ports are reloaded on SIGHUP.
+func (r *Router) reloadOnHangup() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logger.Printf("reloading certificates")
+		r.portsLock.Lock()
+		for _, port := range r.ports {
+			port.ReloadCerts()
+		}
+		r.portsLock.Unlock()
 	}
 }
 
-func (r *Router) AddPort(p uint16) {
-	port, err := NewPort(p, r.config)
+func (r *Router) AddPort(p config.Port) {
+	r.portsLock.Lock()
+	defer r.portsLock.Unlock()
+
+	r.addPort(p)
+}
+
+// Must be called holding lock on ports.
+func (r *Router) addPort(p config.Port) {
+	port, err := NewPort(p, r.config, r.Tracer)
 	if err != nil {
 		logger.Errorf("%s", err.Error())
 		return
 	}
-	r.ports[p] = port
+	r.ports[p.Port] = port
 	go port.Run(r.ReadTimeout, r.WriteTimeout)
 }
 
+// UpdatePort applies TLS policy and certificate changes in place; only
+// switching between HTTP and HTTPS, or h2c on and off, restarts the listener.
+func (r *Router) UpdatePort(p config.Port) {
+	r.portsLock.Lock()
+	defer r.portsLock.Unlock()
+
+	port, ok := r.ports[p.Port]
+	if !ok {
+		r.addPort(p)
+		return
+	}
+	if port.IsTLS() == p.TLS && port.h2c == (p.H2C && !p.TLS) && (port.proxy != nil) == p.ProxyProtocol {
+		port.Reconfigure(p)
+		return
+	}
+
+	logger.Printf("[port %d] restarting listener, tls %t, h2c %t, proxy protocol %t", p.Port, p.TLS, p.H2C,
+		p.ProxyProtocol)
+	port.Shutdown()
+	delete(r.ports, p.Port)
+	r.addPort(p)
+}
+
 func (r *Router) DelPort(p uint16) {
-	r.ports[p].Shutdown()
+	r.portsLock.Lock()
+	defer r.portsLock.Unlock()
+
+	if port, ok := r.ports[p]; ok {
+		port.Shutdown()
+		delete(r.ports, p)
+	}
 }
 
 func (r *Router) IsConnectedToZk() bool {
@@ -0,0 +1,186 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// W3C Trace Context and Zipkin B3 headers.
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+	B3Header          = "B3"
+	B3TraceIDHeader   = "X-B3-Traceid"
+	B3SpanIDHeader    = "X-B3-Spanid"
+	B3ParentIDHeader  = "X-B3-Parentspanid"
+	B3SampledHeader   = "X-B3-Sampled"
+	B3FlagsHeader     = "X-B3-Flags"
+)
+
+// How a trace came in, and so goes on.
+const (
+	propagateW3C = iota
+	propagateB3Single
+	propagateB3Multi
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext is what the next hop gets to know of a span.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+	// whether Sampled was decided upstream, B3 may leave it to us
+	decided   bool
+	propagate int
+}
+
+// Extract returns the span context a request continues, preferring W3C
+// traceparent over B3 headers. Returns false if there is none, or it is
+// malformed.
+func Extract(header http.Header) (SpanContext, bool) {
+	if value := header.Get(TraceparentHeader); value != "" {
+		sc, ok := parseTraceparent(value)
+		sc.TraceState = header.Get(TracestateHeader)
+		return sc, ok
+	}
+	if value := header.Get(B3Header); value != "" {
+		return parseB3(value)
+	}
+	if header.Get(B3TraceIDHeader) != "" {
+		return parseB3Multi(header)
+	}
+	return SpanContext{}, false
+}
+
+// version-traceid-parentid-flags, all lower case hex
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) || !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+	sc.Sampled, sc.decided = flags[0]&1 == 1, true
+	return sc, true
+}
+
+// traceid-spanid-sampled-parentspanid, the last two optional, or just sampled
+func parseB3(value string) (SpanContext, bool) {
+	sc := SpanContext{propagate: propagateB3Single}
+	parts := strings.Split(value, "-")
+	if len(parts) < 2 || !decodeTraceID(&sc.TraceID, parts[0]) || !decodeHex(sc.SpanID[:], parts[1]) ||
+		!sc.SpanID.IsValid() {
+		return sc, false
+	}
+	if len(parts) > 2 {
+		switch parts[2] {
+		case "1", "d":
+			sc.Sampled, sc.decided = true, true
+		case "0":
+			sc.decided = true
+		default:
+			return sc, false
+		}
+	}
+	return sc, true
+}
+
+func parseB3Multi(header http.Header) (SpanContext, bool) {
+	sc := SpanContext{propagate: propagateB3Multi}
+	if !decodeTraceID(&sc.TraceID, header.Get(B3TraceIDHeader)) ||
+		!decodeHex(sc.SpanID[:], header.Get(B3SpanIDHeader)) || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+	switch strings.ToLower(header.Get(B3SampledHeader)) {
+	case "1", "true":
+		sc.Sampled, sc.decided = true, true
+	case "0", "false":
+		sc.decided = true
+	}
+	if header.Get(B3FlagsHeader) == "1" {
+		sc.Sampled, sc.decided = true, true
+	}
+	return sc, true
+}
+
+// B3 trace IDs may be 64 bits, which are the low half of ours.
+func decodeTraceID(id *TraceID, value string) bool {
+	if len(value) == 16 {
+		value = strings.Repeat("0", 16) + value
+	}
+	return decodeHex(id[:], value) && id.IsValid()
+}
+
+func decodeHex(dst []byte, value string) bool {
+	if len(value) != 2*len(dst) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err == nil
+}
+
+// Inject sets the headers passing sc on to the next hop: traceparent and
+// tracestate, and B3 too if that is how the trace came in.
+func Inject(header http.Header, sc SpanContext) {
+	flags := 0
+	if sc.Sampled {
+		flags = 1
+	}
+	header.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, flags))
+	if sc.TraceState != "" {
+		header.Set(TracestateHeader, sc.TraceState)
+	} else {
+		header.Del(TracestateHeader)
+	}
+
+	switch sc.propagate {
+	case propagateB3Single:
+		header.Set(B3Header, fmt.Sprintf("%s-%s-%d", sc.TraceID, sc.SpanID, flags))
+	case propagateB3Multi:
+		header.Del(B3ParentIDHeader)
+		header.Del(B3FlagsHeader)
+		header.Set(B3TraceIDHeader, sc.TraceID.String())
+		header.Set(B3SpanIDHeader, sc.SpanID.String())
+		header.Set(B3SampledHeader, fmt.Sprintf("%d", flags))
+	}
+}
@@ -0,0 +1,132 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package tracing
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestExtractTraceparent(t *testing.T) {
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-"+testTraceID+"-"+testSpanID+"-01")
+	header.Set(TracestateHeader, "congo=t61rcWkgMzE")
+	sc, ok := Extract(header)
+	if !ok || sc.TraceID.String() != testTraceID || sc.SpanID.String() != testSpanID {
+		t.Fatalf("should extract trace and span id")
+	}
+	if !sc.Sampled || !sc.decided || sc.TraceState != "congo=t61rcWkgMzE" {
+		t.Errorf("should extract sampled flag and trace state")
+	}
+
+	invalid := []string{
+		"",
+		"00-" + testTraceID + "-" + testSpanID,
+		"00-" + testTraceID + "-" + testSpanID + "-01-extra",
+		"ff-" + testTraceID + "-" + testSpanID + "-01",
+		"00-00000000000000000000000000000000-" + testSpanID + "-01",
+		"00-" + testTraceID + "-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + testSpanID + "-01",
+		"00-" + testTraceID + "-" + testSpanID + "-x1",
+	}
+	for _, value := range invalid {
+		header.Set(TraceparentHeader, value)
+		if _, ok := Extract(header); ok {
+			t.Errorf("should reject traceparent %q", value)
+		}
+	}
+
+	// later versions may add fields
+	header.Set(TraceparentHeader, "01-"+testTraceID+"-"+testSpanID+"-00-extra")
+	if sc, ok := Extract(header); !ok || sc.Sampled {
+		t.Errorf("should accept traceparent of later version")
+	}
+}
+
+func TestExtractB3(t *testing.T) {
+	header := http.Header{}
+	header.Set(B3Header, "a3ce929d0e0e4736-"+testSpanID+"-1-05e3ac9a4f6e3b90")
+	sc, ok := Extract(header)
+	if !ok || sc.TraceID.String() != "0000000000000000a3ce929d0e0e4736" || sc.SpanID.String() != testSpanID {
+		t.Fatalf("should extract 64 bit trace id from b3 header")
+	}
+	if !sc.Sampled || sc.propagate != propagateB3Single {
+		t.Errorf("should extract sampling state from b3 header")
+	}
+
+	header.Set(B3Header, testTraceID+"-"+testSpanID)
+	if sc, ok := Extract(header); !ok || sc.decided {
+		t.Errorf("should defer sampling without sampling state")
+	}
+	header.Set(B3Header, "0")
+	if _, ok := Extract(header); ok {
+		t.Errorf("should not continue trace of b3 header without ids")
+	}
+
+	header = http.Header{}
+	header.Set(B3TraceIDHeader, testTraceID)
+	header.Set(B3SpanIDHeader, testSpanID)
+	header.Set(B3SampledHeader, "0")
+	sc, ok = Extract(header)
+	if !ok || sc.TraceID.String() != testTraceID || sc.Sampled || !sc.decided || sc.propagate != propagateB3Multi {
+		t.Errorf("should extract x-b3 headers")
+	}
+	header.Set(B3FlagsHeader, "1")
+	if sc, _ := Extract(header); !sc.Sampled {
+		t.Errorf("should sample debug traces")
+	}
+
+	// traceparent wins
+	header.Set(TraceparentHeader, "00-"+testTraceID+"-"+testSpanID+"-01")
+	if sc, _ := Extract(header); sc.propagate != propagateW3C {
+		t.Errorf("should prefer traceparent over b3")
+	}
+}
+
+func TestInject(t *testing.T) {
+	header := http.Header{}
+	header.Set(TracestateHeader, "stale=1")
+	header.Set(B3TraceIDHeader, testTraceID)
+	header.Set(B3SpanIDHeader, testSpanID)
+	header.Set(B3ParentIDHeader, "05e3ac9a4f6e3b90")
+	sc, _ := Extract(header)
+	sc.SpanID = SpanID{1, 2, 3, 4, 5, 6, 7, 8}
+	sc.Sampled = true
+	Inject(header, sc)
+
+	expected := map[string]string{
+		TraceparentHeader: "00-" + testTraceID + "-0102030405060708-01",
+		TracestateHeader:  "",
+		B3TraceIDHeader:   testTraceID,
+		B3SpanIDHeader:    "0102030405060708",
+		B3SampledHeader:   "1",
+		B3ParentIDHeader:  "",
+	}
+	for name, value := range expected {
+		if header.Get(name) != value {
+			t.Errorf("should set %s to %s, got %s", name, value, header.Get(name))
+		}
+	}
+
+	header = http.Header{}
+	sc.propagate = propagateB3Single
+	sc.Sampled = false
+	Inject(header, sc)
+	if header.Get(B3Header) != testTraceID+"-0102030405060708-0" || header.Get(B3TraceIDHeader) != "" {
+		t.Errorf("should pass b3 header on as single header, got %s", header.Get(B3Header))
+	}
+}
@@ -0,0 +1,239 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Name of the router in exported spans.
+const ServiceName = "atlantis-router"
+
+const DefaultExportTimeout = 10 * time.Second
+
+// An Exporter sends finished spans somewhere. Export is called from a single
+// goroutine.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// NewExporter returns the exporter for the URL: OTLP/HTTP to http(s) URLs,
+// such as http://localhost:4318/v1/traces, or JSON lines appended to the file
+// of file URLs, such as file:///tmp/spans.json.
+func NewExporter(rawURL string) (Exporter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewOTLPExporter(rawURL), nil
+	case "file":
+		return NewFileExporter(u.Path), nil
+	default:
+		return nil, fmt.Errorf("unsupported span exporter %q", rawURL)
+	}
+}
+
+// Sends spans to an OpenTelemetry collector as OTLP/HTTP JSON.
+type OTLPExporter struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: DefaultExportTimeout},
+	}
+}
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	body, err := json.Marshal(newOTLPTraces(spans))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", e.Endpoint, res.Status)
+	}
+	return nil
+}
+
+// Appends spans to a file, one OTLP JSON span per line.
+type FileExporter struct {
+	sync.Mutex
+	Path string
+}
+
+func NewFileExporter(path string) *FileExporter {
+	return &FileExporter{Path: path}
+}
+
+func (e *FileExporter) Export(spans []*Span) error {
+	e.Lock()
+	defer e.Unlock()
+
+	file, err := os.OpenFile(e.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(file)
+	for _, span := range spans {
+		if err = enc.Encode(newOTLPSpan(span)); err != nil {
+			break
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// The OTLP JSON encoding, as far as spans go.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// 64 bit integers are strings in JSON.
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+const otlpStatusError = 2
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+func newOTLPTraces(spans []*Span) otlpTraces {
+	list := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		list[i] = newOTLPSpan(span)
+	}
+
+	return otlpTraces{[]otlpResourceSpans{{
+		Resource:   otlpResource{newOTLPAttributes(map[string]interface{}{"service.name": ServiceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{ServiceName}, Spans: list}},
+	}}}
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	s := otlpSpan{
+		TraceID:           span.TraceID.String(),
+		SpanID:            span.SpanID.String(),
+		TraceState:        span.TraceState,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Attributes:        newOTLPAttributes(span.Attributes),
+	}
+	if span.ParentID.IsValid() {
+		s.ParentSpanID = span.ParentID.String()
+	}
+	if span.Error {
+		s.Status.Code = otlpStatusError
+	}
+	return s
+}
+
+// Sorted by key, values of other types become strings.
+func newOTLPAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := make([]otlpKeyValue, len(keys))
+	for i, key := range keys {
+		var value otlpAnyValue
+		switch v := attributes[key].(type) {
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case uint64:
+			s := strconv.FormatUint(v, 10)
+			value.IntValue = &s
+		case bool:
+			value.BoolValue = &v
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		list[i] = otlpKeyValue{key, value}
+	}
+	return list
+}
@@ -0,0 +1,127 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSpan() *Span {
+	span := &Span{
+		Name:  "GET",
+		Kind:  SpanKindServer,
+		Start: time.Unix(1, 0),
+		End:   time.Unix(2, 0),
+		Error: true,
+	}
+	span.TraceID = TraceID{15: 1}
+	span.SpanID = SpanID{7: 2}
+	span.ParentID = SpanID{7: 3}
+	span.SetAttribute("pool", "app")
+	span.SetAttribute("http.response.status_code", 502)
+	return span
+}
+
+func TestNewExporter(t *testing.T) {
+	if e, err := NewExporter("http://localhost:4318/v1/traces"); err != nil {
+		t.Errorf("should export to otlp endpoint: %s", err)
+	} else if _, ok := e.(*OTLPExporter); !ok {
+		t.Errorf("should export to otlp endpoint")
+	}
+	if e, err := NewExporter("file:///tmp/spans.json"); err != nil || e.(*FileExporter).Path != "/tmp/spans.json" {
+		t.Errorf("should export to file")
+	}
+	if _, err := NewExporter("ftp://localhost/"); err == nil {
+		t.Errorf("should reject unknown exporter")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("should post json, got %s", r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+
+	if err := NewOTLPExporter(collector.URL).Export([]*Span{testSpan()}); err != nil {
+		t.Fatalf("should export spans: %s", err)
+	}
+	resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	scopeSpans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	span := scopeSpans["spans"].([]interface{})[0].(map[string]interface{})
+	expected := map[string]interface{}{
+		"traceId":           "00000000000000000000000000000001",
+		"spanId":            "0000000000000002",
+		"parentSpanId":      "0000000000000003",
+		"name":              "GET",
+		"kind":              float64(SpanKindServer),
+		"startTimeUnixNano": "1000000000",
+		"endTimeUnixNano":   "2000000000",
+	}
+	for key, value := range expected {
+		if span[key] != value {
+			t.Errorf("should export %s as %v, got %v", key, value, span[key])
+		}
+	}
+	attributes := span["attributes"].([]interface{})
+	status := attributes[0].(map[string]interface{})
+	if status["key"] != "http.response.status_code" || status["value"].(map[string]interface{})["intValue"] != "502" {
+		t.Errorf("should export sorted typed attributes, got %v", attributes)
+	}
+	if span["status"].(map[string]interface{})["code"] != float64(otlpStatusError) {
+		t.Errorf("should export error status")
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	if err := NewOTLPExporter(failing.URL).Export([]*Span{testSpan()}); err == nil {
+		t.Errorf("should fail when collector does")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tracing")
+	defer os.RemoveAll(dir)
+	exporter := NewFileExporter(filepath.Join(dir, "spans.json"))
+
+	exporter.Export([]*Span{testSpan()})
+	exporter.Export([]*Span{testSpan(), testSpan()})
+
+	file, err := os.Open(exporter.Path)
+	if err != nil {
+		t.Fatalf("should create file: %s", err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+		var span otlpSpan
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil || span.Name != "GET" {
+			t.Errorf("should write a span per line: %s", scanner.Text())
+		}
+	}
+	if lines != 3 {
+		t.Errorf("should append spans, got %d lines", lines)
+	}
+}
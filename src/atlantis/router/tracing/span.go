@@ -0,0 +1,269 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package tracing
+
+import (
+	"atlantis/router/logger"
+	"context"
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"time"
+)
+
+// Span kinds, numbered as in OTLP.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+const (
+	DefaultBatchSize     = 512
+	DefaultBatchInterval = 5 * time.Second
+	// Spans finished while this many wait for export are dropped.
+	queueSize = 4096
+)
+
+// A Span times one step of a request. Spans are not safe for concurrent use,
+// but a nil span is, doing nothing, which is what requests get when tracing
+// is off.
+type Span struct {
+	SpanContext
+	ParentID   SpanID
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      bool
+	tracer     *Tracer
+}
+
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+
+	child := &Span{
+		SpanContext: s.SpanContext,
+		ParentID:    s.SpanID,
+		Name:        name,
+		Kind:        kind,
+		Start:       time.Now(),
+		tracer:      s.tracer,
+	}
+	child.SpanID = newSpanID()
+	return child
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+}
+
+// SetStatus records the HTTP status of the response, server errors marking
+// the span as failed.
+func (s *Span) SetStatus(code int) {
+	if s == nil {
+		return
+	}
+
+	s.SetAttribute("http.response.status_code", code)
+	s.Error = s.Error || code >= 500
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+
+	s.SetAttribute("error.message", err.Error())
+	s.Error = true
+}
+
+// SetResult records the outcome of a round trip, either response or error.
+func (s *Span) SetResult(res *http.Response, err error) {
+	if err != nil {
+		s.SetError(err)
+	} else if res != nil {
+		s.SetStatus(res.StatusCode)
+	}
+}
+
+// Inject passes the span on to the next hop in the request headers.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+
+	Inject(header, s.SpanContext)
+}
+
+// Finish ends the span, queueing it for export if sampled. Spans must be
+// finished at most once.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.End = time.Now()
+	if s.Sampled {
+		s.tracer.export(s)
+	}
+}
+
+type spanKey struct{}
+
+func NewContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// FromContext returns the span of a request, or nil if it has none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// A Tracer starts the spans of requests and exports the sampled ones in
+// batches. A nil tracer is off.
+type Tracer struct {
+	exporter Exporter
+	spans    chan *Span
+	quit     chan bool
+	done     chan bool
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		spans:    make(chan *Span, queueSize),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+	go t.run()
+	return t
+}
+
+// StartRequest starts the server span of a request, continuing the trace in
+// its headers if there is one. Its sampling decision is followed if it made
+// one, otherwise requests are sampled at rate, from 0 to 1.
+func (t *Tracer) StartRequest(req *http.Request, name string, rate float64) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{
+		Name:   name,
+		Kind:   SpanKindServer,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	parent, ok := Extract(req.Header)
+	if ok {
+		span.SpanContext = parent
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newTraceID()
+	}
+	if !span.decided {
+		span.Sampled = rate > 0 && mrand.Float64() < rate
+		span.decided = true
+	}
+	span.SpanID = newSpanID()
+	return span
+}
+
+// Shutdown exports the spans still queued. Spans finished afterwards are
+// dropped.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+
+	close(t.quit)
+	<-t.done
+}
+
+func (t *Tracer) export(span *Span) {
+	select {
+	case <-t.quit:
+	case t.spans <- span:
+	default:
+		logger.Debugf("[tracing] queue full, dropped span %s of trace %s\n", span.Name, span.TraceID)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(DefaultBatchInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			logger.Errorf("[tracing] failed exporting %d spans: %s\n", len(batch), err)
+		}
+		batch = []*Span{}
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			if batch = append(batch, span); len(batch) >= DefaultBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.quit:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			flush()
+			close(t.done)
+			return
+		}
+	}
+}
+
+func newTraceID() (id TraceID) {
+	randomID(id[:])
+	return
+}
+
+func newSpanID() (id SpanID) {
+	randomID(id[:])
+	return
+}
+
+// All zero IDs are invalid, though unlikely.
+func randomID(id []byte) {
+	for {
+		if _, err := rand.Read(id); err != nil {
+			panic(fmt.Sprintf("tracing: failed reading random ID: %s", err))
+		}
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/* Copyright 2014 Ooyala, Inc. All rights reserved.
+ *
+ * This file is licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License. You may obtain a copy of the License at
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and limitations under the License.
+ */
+
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type recorder struct {
+	spans []*Span
+}
+
+func (r *recorder) Export(spans []*Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestNilSpan(t *testing.T) {
+	var tracer *Tracer
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	span := tracer.StartRequest(req, "GET", 1)
+	if span != nil {
+		t.Fatalf("should not start spans when tracing is off")
+	}
+
+	child := span.Child("route", SpanKindInternal)
+	child.SetAttribute("pool", "app")
+	child.SetResult(nil, errors.New("failed"))
+	child.Inject(req.Header)
+	child.Finish()
+	tracer.Shutdown()
+	if len(req.Header) != 0 {
+		t.Errorf("should not inject headers when tracing is off")
+	}
+}
+
+func TestStartRequest(t *testing.T) {
+	rec := &recorder{}
+	tracer := NewTracer(rec)
+	req, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+
+	span := tracer.StartRequest(req, "GET", 1)
+	if !span.TraceID.IsValid() || !span.SpanID.IsValid() || span.ParentID.IsValid() || !span.Sampled {
+		t.Errorf("should start sampled trace at rate 1")
+	}
+	child := span.Child("route", SpanKindInternal)
+	if child.TraceID != span.TraceID || child.ParentID != span.SpanID || child.SpanID == span.SpanID {
+		t.Errorf("should start child span in same trace")
+	}
+	child.Finish()
+	span.SetStatus(http.StatusBadGateway)
+	span.Finish()
+
+	if span := tracer.StartRequest(req, "GET", 0); span.Sampled {
+		t.Errorf("should not sample new trace at rate 0")
+	}
+
+	req.Header.Set(TraceparentHeader, "00-"+testTraceID+"-"+testSpanID+"-01")
+	span = tracer.StartRequest(req, "GET", 0)
+	if span.TraceID.String() != testTraceID || span.ParentID.String() != testSpanID || !span.Sampled {
+		t.Errorf("should continue sampled trace regardless of rate")
+	}
+	req.Header.Set(TraceparentHeader, "00-"+testTraceID+"-"+testSpanID+"-00")
+	if span := tracer.StartRequest(req, "GET", 1); span.Sampled {
+		t.Errorf("should not sample trace upstream didn't")
+	}
+
+	tracer.Shutdown()
+	if len(rec.spans) != 2 || rec.spans[0] != child || rec.spans[1].Error != true {
+		t.Errorf("should export finished sampled spans on shutdown, got %d", len(rec.spans))
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"atlantis/router/logger"
 	"errors"
 	"github.com/scalingdata/gozk"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,6 +24,7 @@ type ZkConn struct {
 	sync.Mutex
 	ResetCh   chan bool
 	servers   string
+	auth      string
 	Conn      *zookeeper.Conn
 	eventCh   <-chan zookeeper.Event
 	killCh    chan bool
@@ -30,9 +32,21 @@ type ZkConn struct {
 }
 
 func ManagedZkConn(servers string) *ZkConn {
+	return ManagedZkConnAuth(servers, "")
+}
+
+// ManagedZkConnAuth is ManagedZkConn authenticating every session as auth,
+// scheme:credentials such as digest:router:secret, which reading certificates
+// needs, see CertACL.
+func ManagedZkConnAuth(servers, auth string) *ZkConn {
+	if auth != "" && !strings.Contains(auth, ":") {
+		logger.Errorf("[zkconn] %s is not valid auth, want scheme:credentials", auth)
+		auth = ""
+	}
 	zk := &ZkConn{
 		ResetCh:   make(chan bool),
 		servers:   servers,
+		auth:      auth,
 		killCh:    make(chan bool),
 		connected: false,
 	}
@@ -71,6 +85,12 @@ func (z *ZkConn) dial() error {
 	if err != nil {
 		return err
 	}
+	if z.auth != "" {
+		parts := strings.SplitN(z.auth, ":", 2)
+		if err = z.Conn.AddAuth(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
 	z.connected = true
 
 	go z.monitorEventCh()
@@ -26,6 +26,7 @@ var ZkPaths map[string]string = map[string]string{
 	"rules": "/rules",
 	"tries": "/tries",
 	"ports": "/ports",
+	"certs": "/certs",
 }
 
 func SetZkRoot(root string) {
@@ -33,6 +34,7 @@ func SetZkRoot(root string) {
 	ZkPaths["rules"] = path.Join(root, "rules")
 	ZkPaths["tries"] = path.Join(root, "tries")
 	ZkPaths["ports"] = path.Join(root, "ports")
+	ZkPaths["certs"] = path.Join(root, "certs")
 }
 
 func PoolExists(zk *zookeeper.Conn, name string) (bool, error) {
@@ -414,3 +416,67 @@ func DelPort(zk *zookeeper.Conn, port uint16) error {
 	err = zk.Delete(zkPath, -1)
 	return err
 }
+
+// Certificate nodes hold private keys, so only the identities the creating
+// connection authenticated as may read or change them. Writers must call
+// AddAuth before SetCert, and routers authenticate the same way, see
+// ManagedZkConnAuth.
+var CertACL = zookeeper.AuthACL(zookeeper.PERM_ALL)
+
+func CertExists(zk *zookeeper.Conn, name string) (bool, error) {
+	stat, err := zk.Exists(path.Join(ZkPaths["certs"], name))
+	return (stat != nil), err
+}
+
+func ListCerts(zk *zookeeper.Conn) ([]string, error) {
+	certs, _, err := zk.Children(ZkPaths["certs"])
+	return certs, err
+}
+
+func GetCert(zk *zookeeper.Conn, name string) (cert config.Cert, err error) {
+	zkPath := path.Join(ZkPaths["certs"], name)
+
+	jsonBlob, _, err := zk.Get(zkPath)
+	if err != nil {
+		return config.Cert{}, err
+	}
+
+	err = json.Unmarshal([]byte(jsonBlob), &cert)
+	return cert, err
+}
+
+func SetCert(zk *zookeeper.Conn, cert config.Cert) error {
+	zkPath := path.Join(ZkPaths["certs"], cert.Name)
+
+	jsonBlob, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+
+	stat, err := zk.Exists(zkPath)
+	if err != nil {
+		return err
+	}
+
+	if stat == nil {
+		_, err = zk.Create(zkPath, string(jsonBlob), 0, CertACL)
+	} else {
+		_, err = zk.Set(zkPath, string(jsonBlob), -1)
+	}
+	return err
+}
+
+func DelCert(zk *zookeeper.Conn, name string) error {
+	zkPath := path.Join(ZkPaths["certs"], name)
+
+	stat, err := zk.Exists(zkPath)
+	if err != nil {
+		return err
+	}
+	if stat == nil {
+		return nil
+	}
+
+	err = zk.Delete(zkPath, -1)
+	return err
+}
@@ -48,7 +48,7 @@ func TestStartServer(t *testing.T) {
 		t.Fatalf("cannot create zk root")
 	}
 
-	for _, node := range []string{"pools", "rules", "tries", "ports"} {
+	for _, node := range []string{"pools", "rules", "tries", "ports", "certs"} {
 		zkPath := path.Join(zkRoot, node)
 		_, err = zkConn.Conn.Create(zkPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
 		if err != nil {
@@ -228,6 +228,9 @@ func TestAddHosts(t *testing.T) {
 		},
 		"test2": config.Host{
 			Address: "localhost:8082",
+			Weight:  200,
+			Zone:    "us-east-1a",
+			Tags:    map[string]string{"size": "xlarge"},
 		},
 	}
 
@@ -260,7 +263,7 @@ func TestAddHosts(t *testing.T) {
 
 	if err := json.Unmarshal([]byte(jsonBlob), &node); err != nil {
 		t.Errorf("should marshal correctly")
-	} else if node != newHosts["test2"] {
+	} else if !node.Equals(newHosts["test2"]) {
 		t.Errorf("should marshal accurately")
 	}
 }
@@ -889,8 +892,8 @@ func TestGetPool(t *testing.T) {
 		t.Errorf("should get pool")
 	} else {
 		if node.Name != pool.Name || node.Internal != pool.Internal ||
-			node.Config != pool.Config || node.Hosts["test0"] != pool.Hosts["test0"] ||
-			node.Hosts["test1"] != pool.Hosts["test1"] {
+			node.Config != pool.Config || !node.Hosts["test0"].Equals(pool.Hosts["test0"]) ||
+			!node.Hosts["test1"].Equals(pool.Hosts["test1"]) {
 			t.Errorf("should get pool accurately")
 		}
 	}
@@ -982,6 +985,31 @@ func TestGetPort(t *testing.T) {
 	}
 }
 
+func TestSetGetDelCert(t *testing.T) {
+	cert := config.Cert{Name: "www", Cert: "cert pem", Key: "key pem"}
+
+	if err := zkConn.Conn.AddAuth("digest", "router:secret"); err != nil {
+		t.Fatalf("cannot authenticate")
+	}
+	if err := SetCert(zkConn.Conn, cert); err != nil {
+		t.Fatalf("cannot create cert")
+	}
+
+	node, err := GetCert(zkConn.Conn, "www")
+	if err != nil {
+		t.Errorf("should get cert")
+	} else if node.Cert != cert.Cert || node.Key != cert.Key {
+		t.Errorf("should get cert accurately")
+	}
+
+	if err := DelCert(zkConn.Conn, "www"); err != nil {
+		t.Errorf("should delete cert")
+	}
+	if exists, err := CertExists(zkConn.Conn, "www"); err != nil || exists {
+		t.Errorf("should not find deleted cert")
+	}
+}
+
 // Not a test, but go test won't run it otherwise.
 func TestStopServer(t *testing.T) {
 	zkConn.Conn.Close()